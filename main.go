@@ -2,57 +2,160 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
-	"net/http"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Uchencho/Account/server"
-
-	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
-const (
-	// default server address
-	defaultServerAddress = "127.0.0.1:8000"
-)
+// Usage: account [flags] [command [command flags]]
+// Without a command the api is served
+func main() {
+
+	// A .env file is optional, variables already set in the environment win
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Could not load .env file, with error: %s", err)
+	}
 
-func init() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("No .env file found, with error: %s", err)
+	cfg, args, err := server.LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logger := server.NewLogger(os.Stdout, cfg.LogLevel)
+
+	// Run until interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	command := "serve"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "serve":
+		err = serve(ctx, cfg, logger)
+	case "migrate":
+		err = migrate(ctx, cfg, logger, args)
+	case "normalize-emails":
+		err = normalizeEmails(ctx, cfg, logger, args)
+	default:
+		log.Fatalf("Unknown command %s, expected serve, migrate or normalize-emails", command)
+	}
+	if err != nil {
+		logger.Error("Command failed", "command", command, "error", err)
+		os.Exit(1)
 	}
 }
 
-func main() {
+// Serves the api until ctx is done, then drains requests before disconnecting
+func serve(ctx context.Context, cfg server.Config, logger *slog.Logger) error {
+	shutdownTracing, err := server.SetupTracing(ctx, cfg, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	db, err := server.OpenStorage(ctx, cfg, logger)
+	if err != nil {
+		return err
+	}
 
 	defer func() {
-		ctx := context.Background()
-		if err := server.Client.Disconnect(ctx); err != nil {
-			log.Fatalln("Error in disconnecting", err)
+		disconnectCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := db.Disconnect(disconnectCtx); err != nil {
+			logger.Error("Error in disconnecting", "error", err)
+		}
+		if err := shutdownTracing(disconnectCtx); err != nil {
+			logger.Error("Error in flushing traces", "error", err)
 		}
 	}()
 
-	// Using Gorilla Mux as a router
-	router := mux.NewRouter()
-	router.NotFoundHandler = server.BasicToken(http.HandlerFunc(server.NotAvailable))
-
-	router.Handle("/api/register", server.BasicToken(http.HandlerFunc(server.Register)))
-	router.Handle("/api/login", server.BasicToken(http.HandlerFunc(server.Login)))
-	router.Handle("/api/profile", server.TheUser(http.HandlerFunc(server.UserProfile)))
-	router.HandleFunc("/api/refresh-token", server.RefreshTokenAPI)
-
-	// // Using HttpRouter as a router(https://github.com/julienschmidt/httprouter)
-	// /*
-	// 	Current challenge with this router is the fact that you must specify the method coming in
-	//  This means I am unable to handle different methods in the handler, rather would have to repeat
-	//  myself
-	// */
-	// router := httprouter.New()
-	// router.Handler("POST", "/api/register", server.BasicToken(http.HandlerFunc(server.Register)))
-	// router.Handler("POST", "/api/login", server.BasicToken(http.HandlerFunc(server.Login)))
-	// router.Handler("GET", "/api/profile", server.TheUser(http.HandlerFunc(server.UserProfile)))
-	// router.NotFound = server.BasicToken(http.HandlerFunc(server.NotAvailable))
-
-	if err := http.ListenAndServe(defaultServerAddress, router); err != http.ErrServerClosed {
-		log.Println(err)
+	if cfg.MigrateOnStart {
+		if err := db.Migrate(ctx); err != nil {
+			return err
+		}
+	}
+
+	s, err := server.NewServer(cfg, db, logger)
+	if err != nil {
+		return err
+	}
+	return s.ListenAndServe(ctx)
+}
+
+// Applies or rolls back migrations and reports their status.
+// Usage: migrate [apply | status | rollback [-steps n]]
+func migrate(ctx context.Context, cfg server.Config, logger *slog.Logger, args []string) error {
+	action := "apply"
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("migrate "+action, flag.ExitOnError)
+	steps := flags.Int("steps", 1, "how many migrations to roll back")
+	flags.Parse(args)
+
+	db, err := server.OpenStorage(ctx, cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect(context.Background())
+
+	switch action {
+	case "apply":
+		err = db.Migrate(ctx)
+	case "rollback":
+		err = db.Rollback(ctx, *steps)
+	case "status":
+	default:
+		return fmt.Errorf("unknown migrate action %s, expected apply, status or rollback", action)
+	}
+	if err != nil {
+		return err
+	}
+
+	statuses, err := db.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		applied := "pending"
+		if status.Applied {
+			applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%4d  %-32s %s\n", status.Version, status.Name, applied)
+	}
+	return nil
+}
+
+// Rewrites the stored emails to their canonical form, reporting the users
+// whose emails collide once normalized
+func normalizeEmails(ctx context.Context, cfg server.Config, logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("normalize-emails", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would change")
+	flags.Parse(args)
+
+	db, err := server.OpenStorage(ctx, cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect(context.Background())
+
+	report, err := db.NormalizeEmails(ctx, cfg.EmailNormalizer(), *dryRun)
+	if err != nil {
+		return err
+	}
+	for _, collision := range report.Collisions {
+		logger.Warn("Emails collide once normalized, resolve by hand",
+			"email", collision.Email, "stored", collision.Stored)
 	}
+	logger.Info("Normalized emails", "dry_run", *dryRun, "scanned", report.Scanned,
+		"normalized", report.Normalized, "collisions", len(report.Collisions))
+	return nil
 }
@@ -2,10 +2,10 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -17,46 +17,85 @@ type RegisterUser struct {
 	Email           string `json:"email" validate:"required,email"`
 	Password        string `json:"password" validate:"required"`
 	ConfirmPassword string `json:"confirm_password" validate:"eqfield=Password"`
-	DeviceID        string `json:"device_id,omitempty"`
-	FirstName       string `json:"first_name"`
+	DeviceID        string `json:"device_id,omitempty" validate:"max=255"`
+	FirstName       string `json:"first_name" validate:"max=50"`
 }
 
 type User struct {
+	ID             string    `json:"id"`
 	Email          string    `json:"email"`
 	HashedPassword string    `json:"password,omitempty"`
-	FirstName      string    `json:"first_name"`
-	PhoneNumber    string    `json:"phone_number"`
-	UserAddress    string    `json:"user_address"`
+	FirstName      string    `json:"first_name" validate:"max=50"`
+	PhoneNumber    string    `json:"phone_number" validate:"omitempty,e164"`
+	Address        *Address  `json:"address"`
 	IsActive       bool      `json:"is_active"`
 	DateJoined     time.Time `json:"date_joined"`
 	LastLogin      time.Time `json:"last_login"`
-	Longitude      string    `json:"longitude"`
-	Latitude       string    `json:"latitude"`
-	DeviceID       string    `json:"device_id"`
-}
+	Location       *GeoPoint `json:"location"`
+	DeviceID       string    `json:"device_id" validate:"max=255"`
 
-const (
-	frontEndOrigin string = "*"
-)
+	// whether other users can find this one near them
+	Discoverable bool `json:"discoverable"`
 
-var (
-	signingKey        = []byte(os.Getenv("SIGNING_KEY"))
-	refreshSigningKey = []byte(os.Getenv("REFRESH_SIGNING_KEY"))
-)
+	// the address on one line, read by clients from before addresses were
+	// structured. Set from the address, or the legacy value if it did not
+	// parse
+	UserAddress string `json:"user_address"`
+
+	// legacy values of fields that could not be parsed, keyed by field.
+	// A field is removed once its user updates it
+	Unparsed map[string]string `json:"unparsed,omitempty"`
+
+	// incremented by every update, the ETag of the profile
+	Version int64 `json:"version"`
+}
 
 type Key string
 
+// Generates the id of a new user, a random (version 4) UUID
+func newUserID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// tokenIssuer signs and checks the jwt tokens handed to users
+type tokenIssuer struct {
+	signingKey         []byte
+	refreshSigningKey  []byte
+	accessTTL          time.Duration
+	refreshedAccessTTL time.Duration
+	refreshTTL         time.Duration
+	emailChangeTTL     time.Duration
+}
+
+// Creates the token issuer described by the config
+func newTokenIssuer(cfg Config) tokenIssuer {
+	return tokenIssuer{
+		signingKey:         []byte(cfg.SigningKey),
+		refreshSigningKey:  []byte(cfg.RefreshSigningKey),
+		accessTTL:          cfg.AccessTokenTTL,
+		refreshedAccessTTL: cfg.RefreshedAccessTokenTTL,
+		refreshTTL:         cfg.RefreshTokenTTL,
+		emailChangeTTL:     cfg.EmailChangeTTL,
+	}
+}
+
 type tokenDetails struct {
 	RefreshToken string `json:"refresh_token,omitempty" validate:"required"`
 	AccessToken  string `json:"access_token,omitempty"`
 }
 
-// Hashes a password
-func HashPassword(password string) (string, error) {
+// Hashes a password with the given bcrypt cost
+func HashPassword(password string, cost int) (string, error) {
 	if len(password) < 1 {
 		return "", errors.New("Cant hash an empty string")
 	}
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 4)
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), cost)
 	return string(bytes), err
 }
 
@@ -66,21 +105,22 @@ func CheckPasswordHash(password, hash string) error {
 	return err
 }
 
-// Generates an acess and refresh token on authentication
-func GenerateToken(email string) (string, string, error) {
+// Generates an acess and refresh token on authentication. The tokens are
+// issued to the id of the user, so no personal data ends up in them
+func (t tokenIssuer) GenerateToken(userID string) (string, string, error) {
 
-	if len(email) == 0 {
-		return "", "", errors.New("Can't generate token for an invalid email")
+	if len(userID) == 0 {
+		return "", "", errors.New("Can't generate token for an invalid user id")
 	}
 
 	token := jwt.New(jwt.SigningMethodHS256)
 	claims := token.Claims.(jwt.MapClaims)
 
 	claims["authorized"] = true
-	claims["client"] = email
-	claims["exp"] = time.Now().Add(time.Minute * 15).Unix()
+	claims["sub"] = userID
+	claims["exp"] = time.Now().Add(t.accessTTL).Unix()
 
-	accessToken, err := token.SignedString(signingKey)
+	accessToken, err := token.SignedString(t.signingKey)
 	if err != nil {
 		return "", "", err
 	}
@@ -89,10 +129,10 @@ func GenerateToken(email string) (string, string, error) {
 	refreshClaims := refreshToken.Claims.(jwt.MapClaims)
 
 	refreshClaims["authorized"] = true
-	refreshClaims["client"] = email
-	refreshClaims["exp"] = time.Now().Add(time.Hour * 8).Unix()
+	refreshClaims["sub"] = userID
+	refreshClaims["exp"] = time.Now().Add(t.refreshTTL).Unix()
 
-	refreshString, err := refreshToken.SignedString(refreshSigningKey)
+	refreshString, err := refreshToken.SignedString(t.refreshSigningKey)
 	if err != nil {
 		return "", "", err
 	}
@@ -100,44 +140,94 @@ func GenerateToken(email string) (string, string, error) {
 }
 
 // Middleware that checks if a token was passed
-func BasicToken(next http.Handler) http.Handler {
+func (s *Server) BasicToken(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		if r.Header["Authorization"] != nil {
-			if len(strings.Split(r.Header["Authorization"][0], " ")) < 2 {
-				w.WriteHeader(http.StatusForbidden)
-				fmt.Fprint(w, `{"error" : "Invalid token format"}`)
-				return
-			}
-
-			accessToken := strings.Split(r.Header["Authorization"][0], " ")[1]
-			basic_token := os.Getenv("BASIC_TOKEN")
-			if basic_token == accessToken {
-
-				//Allow CORS here
-				w.Header().Set("Access-Control-Allow-Origin", frontEndOrigin)
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-				next.ServeHTTP(w, r)
-				return
-			} else {
-				w.WriteHeader(http.StatusForbidden)
-				fmt.Fprint(w, `{"error" : "Invalid token passed"}`)
-				return
-			}
+		_, span := s.tracer.Start(r.Context(), "BasicToken")
+		client, apiErr := s.checkBasicToken(r)
+		if apiErr != nil {
+			endSpan(span, apiErr)
+			writeError(w, r, apiErr)
+			return
 		}
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprint(w, `{"error" : "Token not passed"}`)
+		span.End()
+		r = r.WithContext(context.WithValue(r.Context(), clientKey, client))
+
+		//Allow CORS here
+		w.Header().Set("Access-Control-Allow-Origin", s.cfg.CORSOrigin)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
+		next.ServeHTTP(w, r)
 	})
 }
 
-// Checks if the accesstoken passed is correct
-func checkAccessToken(accessToken string) (interface{}, error) {
+// Checks the basic token passed with a request, returning the name of the
+// api client it belongs to
+func (s *Server) checkBasicToken(r *http.Request) (string, *APIError) {
+	if r.Header["Authorization"] == nil {
+		return "", newAPIError(http.StatusForbidden, CodeTokenMissing, "Token not passed")
+	}
+	if len(strings.Split(r.Header["Authorization"][0], " ")) < 2 {
+		return "", newAPIError(http.StatusForbidden, CodeTokenMalformed, "Invalid token format")
+	}
+
+	accessToken := strings.Split(r.Header["Authorization"][0], " ")[1]
+	if s.cfg.BasicToken == accessToken {
+		return defaultClient, nil
+	}
+	for client, token := range s.cfg.ClientTokens {
+		if token == accessToken {
+			return client, nil
+		}
+	}
+	return "", newAPIError(http.StatusForbidden, CodeBasicTokenInvalid, "Invalid token passed")
+}
+
+// Key of the name of the api client in the context of a request
+const clientKey Key = "client"
+
+// Name of the api clients authenticating with basic_token
+const defaultClient = "default"
+
+// ClientTokens are the basic tokens of named api clients, keyed by name
+type ClientTokens map[string]string
+
+// ParseClientTokens parses api clients written as name=token pairs
+// separated by commas, e.g web=token1,ios=token2
+func ParseClientTokens(raw string) (ClientTokens, error) {
+	clients := make(ClientTokens)
+	tokens := make(map[string]bool)
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("client tokens should look like web=token,ios=token, got %q", pair)
+		}
+		if parts[0] == defaultClient {
+			return nil, fmt.Errorf("client name %s is kept for basic_token", defaultClient)
+		}
+		if _, ok := clients[parts[0]]; ok {
+			return nil, fmt.Errorf("client %s is given more than once", parts[0])
+		}
+		if tokens[parts[1]] {
+			return nil, fmt.Errorf("client %s shares its token with another client", parts[0])
+		}
+		clients[parts[0]] = parts[1]
+		tokens[parts[1]] = true
+	}
+	return clients, nil
+}
+
+// Checks if the accesstoken passed is correct, returning the id of its user
+func (t tokenIssuer) checkAccessToken(accessToken string) (string, error) {
 	token, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("An error occurred")
 		}
-		return signingKey, nil
+		return t.signingKey, nil
 	})
 
 	if err != nil {
@@ -145,18 +235,20 @@ func checkAccessToken(accessToken string) (interface{}, error) {
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims["client"], nil
+		if userID, ok := claims["sub"].(string); ok && userID != "" {
+			return userID, nil
+		}
 	}
 	return "", errors.New("Credentials not provided")
 }
 
-// Checks if the refresh token passed is correct
-func checkRefreshToken(refreshToken string) (interface{}, error) {
+// Checks if the refresh token passed is correct, returning the id of its user
+func (t tokenIssuer) checkRefreshToken(refreshToken string) (string, error) {
 	token, err := jwt.Parse(refreshToken, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("An error occurred")
 		}
-		return refreshSigningKey, nil
+		return t.refreshSigningKey, nil
 	})
 
 	if err != nil {
@@ -164,21 +256,23 @@ func checkRefreshToken(refreshToken string) (interface{}, error) {
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims["client"], nil
+		if userID, ok := claims["sub"].(string); ok && userID != "" {
+			return userID, nil
+		}
 	}
 	return "", errors.New("Credentials not provided")
 }
 
 // Creates a new access token only
-func newAccessToken(email string) (string, error) {
+func (t tokenIssuer) newAccessToken(userID string) (string, error) {
 	token := jwt.New(jwt.SigningMethodHS256)
 	claims := token.Claims.(jwt.MapClaims)
 
 	claims["authorized"] = true
-	claims["client"] = email
-	claims["exp"] = time.Now().Add(time.Hour * 2).Unix()
+	claims["sub"] = userID
+	claims["exp"] = time.Now().Add(t.refreshedAccessTTL).Unix()
 
-	accessToken, err := token.SignedString(signingKey)
+	accessToken, err := token.SignedString(t.signingKey)
 	if err != nil {
 		return "", err
 	}
@@ -186,46 +280,56 @@ func newAccessToken(email string) (string, error) {
 }
 
 // Middleware that returns the details of the user
-func TheUser(next http.Handler) http.Handler {
+func (s *Server) TheUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		if r.Header["Authorization"] != nil {
-			if len(strings.Split(r.Header["Authorization"][0], " ")) < 2 {
-				w.WriteHeader(http.StatusForbidden)
-				fmt.Fprint(w, `{"error" : "Invalid token format"}`)
-				return
-			}
-
-			accessToken := strings.Split(r.Header["Authorization"][0], " ")[1]
-			email, err := checkAccessToken(accessToken)
-			if err != nil && "Token is expired" == err.Error() {
-				w.WriteHeader(http.StatusUnauthorized)
-				fmt.Fprint(w, `{"error" : "Token has expired, please login"}`)
-				return
-			} else if err != nil {
-				w.WriteHeader(http.StatusUnauthorized)
-				fmt.Fprint(w, `{"error" : "Invalid Token"}`)
-				return
-			}
-
-			user, err := getUser(Client, fmt.Sprint(email))
-			if err != nil {
-				w.WriteHeader(http.StatusUnauthorized)
-				fmt.Fprint(w, `{"error" : "User does not exist"}`)
-				return
-			}
-
-			const userKey Key = "user"
-			ctx := context.WithValue(r.Context(), userKey, user)
-
-			//Allow CORS here
-			w.Header().Set("Access-Control-Allow-Origin", frontEndOrigin)
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-			next.ServeHTTP(w, r.WithContext(ctx))
+		ctx, span := s.tracer.Start(r.Context(), "TheUser")
+		user, err := s.authenticate(ctx, r)
+		if err != nil {
+			endSpan(span, err)
+			writeError(w, r, err)
 			return
 		}
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprint(w, `{"error" : "Token not passed"}`)
+		span.End()
+
+		const userKey Key = "user"
+		ctx = context.WithValue(r.Context(), userKey, user)
+
+		//Allow CORS here
+		w.Header().Set("Access-Control-Allow-Origin", s.cfg.CORSOrigin)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// Returns the user the access token passed with a request belongs to.
+// Rejected requests get an *APIError, storage failures any other error
+func (s *Server) authenticate(ctx context.Context, r *http.Request) (User, error) {
+	if r.Header["Authorization"] == nil {
+		return User{}, newAPIError(http.StatusForbidden, CodeTokenMissing, "Token not passed")
+	}
+	if len(strings.Split(r.Header["Authorization"][0], " ")) < 2 {
+		return User{}, newAPIError(http.StatusForbidden, CodeTokenMalformed, "Invalid token format")
+	}
+
+	accessToken := strings.Split(r.Header["Authorization"][0], " ")[1]
+	userID, err := s.checkAccessToken(ctx, accessToken)
+	if err != nil {
+		s.metrics.tokenRejected("access", err)
+	}
+	if err != nil && "Token is expired" == err.Error() {
+		return User{}, newAPIError(http.StatusUnauthorized, CodeTokenExpired, "Token has expired, please login")
+	} else if err != nil {
+		return User{}, newAPIError(http.StatusUnauthorized, CodeTokenInvalid, "Invalid Token")
+	}
+
+	user, err := s.getUserByID(ctx, userID)
+	if errors.Is(err, errUserNotFound) {
+		return User{}, newAPIError(http.StatusUnauthorized, CodeUserNotFound, "User does not exist")
+	} else if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
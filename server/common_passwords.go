@@ -0,0 +1,24 @@
+package server
+
+// Bundled list of the most common passwords, always rejected unless
+// a different list is configured
+var commonPasswordList = NewBreachedPasswords(
+	"123456", "123456789", "12345678", "password", "qwerty123", "qwerty1",
+	"111111", "12345", "secret", "123123", "1234567890", "1234567",
+	"000000", "qwerty", "abc123", "password1", "iloveyou", "11111111",
+	"dragon", "monkey", "123123123", "123321", "qwertyuiop", "00000000",
+	"Password", "654321", "target123", "tinkle", "zag12wsx", "gwerty",
+	"1q2w3e4r", "1q2w3e4r5t", "1qaz2wsx", "qazwsx", "987654321", "88888888",
+	"666666", "password123", "princess", "sunshine", "football", "baseball",
+	"welcome", "welcome1", "letmein", "trustno1", "superman", "batman",
+	"starwars", "whatever", "shadow", "master", "michael", "jennifer",
+	"charlie", "jordan23", "passw0rd", "p@ssw0rd", "P@ssw0rd", "Password1",
+	"Password123", "admin", "admin123", "administrator", "root", "toor",
+	"changeme", "default", "guest", "login", "access", "computer",
+	"internet", "freedom", "pokemon", "liverpool", "chelsea", "arsenal",
+	"manchester", "nigeria", "lagos123", "naruto", "asdfghjk", "asdfghjkl",
+	"zxcvbnm", "zxcvbnm123", "qwer1234", "abcd1234", "aa123456", "a123456",
+	"123qwe", "1234qwer", "q1w2e3r4", "q1w2e3r4t5", "iloveyou1", "lovely",
+	"loveme", "mustang", "hello123", "hellohello", "11223344", "12341234",
+	"55555555", "99999999", "87654321", "asdf1234",
+)
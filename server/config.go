@@ -0,0 +1,438 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nyaruka/phonenumbers"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds every setting of the service. Each field is named by its
+// config tag: the key in a config file, the upper cased environment
+// variable and the flag with dashes, e.g mongo_uri, MONGO_URI and -mongo-uri
+type Config struct {
+	Address         string        `config:"address" usage:"address the server listens on"`
+	ReadTimeout     time.Duration `config:"read_timeout" usage:"maximum time to read a request"`
+	WriteTimeout    time.Duration `config:"write_timeout" usage:"maximum time to write a response"`
+	IdleTimeout     time.Duration `config:"idle_timeout" usage:"how long idle keep-alive connections are kept open"`
+	DrainDelay      time.Duration `config:"drain_delay" usage:"how long to report not ready before shutting down, so load balancers stop routing traffic, 0 only without one"`
+	ShutdownTimeout time.Duration `config:"shutdown_timeout" usage:"maximum time to wait for in flight requests on shutdown"`
+	LogLevel        string        `config:"log_level" usage:"lowest level logged, one of debug, info, warn or error"`
+	TraceExporter   string        `config:"trace_exporter" usage:"where spans are exported, one of none, stdout or otlp"`
+	OTLPEndpoint    string        `config:"otlp_endpoint" usage:"OTLP/HTTP url spans are sent to with the otlp exporter"`
+
+	Storage string `config:"storage" usage:"where users are stored, one of mongo, postgres, sqlite or memory"`
+
+	MongoURI              string        `config:"mongo_uri" usage:"MongoDB connection string"`
+	Database              string        `config:"database" usage:"MongoDB database name"`
+	MongoConnectTimeout   time.Duration `config:"mongo_connect_timeout" usage:"maximum time for a single attempt at connecting to MongoDB"`
+	MongoOperationTimeout time.Duration `config:"mongo_operation_timeout" usage:"maximum time for a single storage operation"`
+	MongoConnectRetries   int           `config:"mongo_connect_retries" usage:"how many times a failed connection to MongoDB is retried on startup"`
+	MongoRetryBackoff     time.Duration `config:"mongo_retry_backoff" usage:"wait before the first connection retry, doubled on each retry"`
+	MongoMaxPoolSize      uint64        `config:"mongo_max_pool_size" usage:"maximum number of connections to MongoDB"`
+	MongoMinPoolSize      uint64        `config:"mongo_min_pool_size" usage:"number of connections to MongoDB kept open"`
+	MigrateOnStart        bool          `config:"migrate_on_start" usage:"apply pending migrations before serving, instead of with the migrate command"`
+
+	PostgresURL              string        `config:"postgres_url" usage:"PostgreSQL connection string, used by the postgres storage"`
+	PostgresConnectTimeout   time.Duration `config:"postgres_connect_timeout" usage:"maximum time for a single attempt at connecting to PostgreSQL"`
+	PostgresOperationTimeout time.Duration `config:"postgres_operation_timeout" usage:"maximum time for a single storage operation"`
+	PostgresConnectRetries   int           `config:"postgres_connect_retries" usage:"how many times a failed connection to PostgreSQL is retried on startup"`
+	PostgresRetryBackoff     time.Duration `config:"postgres_retry_backoff" usage:"wait before the first connection retry, doubled on each retry"`
+	PostgresMaxConns         int           `config:"postgres_max_conns" usage:"maximum number of connections to PostgreSQL"`
+
+	SQLitePath        string        `config:"sqlite_path" usage:"file of the sqlite storage, :memory: keeps it in memory"`
+	SQLiteBusyTimeout time.Duration `config:"sqlite_busy_timeout" usage:"how long a storage operation waits for another one writing to sqlite"`
+
+	SigningKey        string       `config:"signing_key" usage:"key access tokens are signed with"`
+	RefreshSigningKey string       `config:"refresh_signing_key" usage:"key refresh tokens are signed with"`
+	BasicToken        string       `config:"basic_token" usage:"token api clients authenticate with"`
+	ClientTokens      ClientTokens `config:"client_tokens" usage:"tokens of named api clients, like web=token1,ios=token2, each limited on its own by rate_limit_client"`
+
+	AccessTokenTTL          time.Duration `config:"access_token_ttl" usage:"lifetime of access tokens issued on login"`
+	RefreshedAccessTokenTTL time.Duration `config:"refreshed_access_token_ttl" usage:"lifetime of access tokens issued from a refresh token"`
+	RefreshTokenTTL         time.Duration `config:"refresh_token_ttl" usage:"lifetime of refresh tokens"`
+	EmailChangeTTL          time.Duration `config:"email_change_ttl" usage:"how long the link confirming an email change is valid"`
+	BcryptCost              int           `config:"bcrypt_cost" usage:"bcrypt cost passwords are hashed with"`
+	CORSOrigin              string        `config:"cors_origin" usage:"origin allowed to call the api from a browser"`
+	TrustProxyHeaders       bool          `config:"trust_proxy_headers" usage:"take the client ip from X-Forwarded-For, only when behind a proxy that sets it"`
+	TrustedProxyHops        int           `config:"trusted_proxy_hops" usage:"number of proxies appending to X-Forwarded-For in front of the server, the client ip is the one the outermost added"`
+	RequireIfMatch          bool          `config:"require_if_match" usage:"profile updates on /api/v1 need an If-Match header with the ETag of the profile they change, the unversioned legacy routes never require it"`
+
+	PhoneDefaultRegion string `config:"phone_default_region" usage:"country code phone numbers without their country code are read in when the address has no country, like NG"`
+
+	NearbyUsers     bool `config:"nearby_users" usage:"serve the endpoint finding the discoverable users near the logged in user"`
+	NearbyMaxRadius int  `config:"nearby_max_radius" usage:"largest radius in meters users can be searched within"`
+
+	EmailLowercaseLocalPart bool `config:"email_lowercase_local_part" usage:"lowercase the part of emails before the @, the domain is always lowercased"`
+	EmailIDN                bool `config:"email_idn" usage:"store internationalized email domains in their ascii (punycode) form"`
+
+	PublicURL    string `config:"public_url" usage:"url the api is reached at by users, links in mails point to it"`
+	SMTPAddress  string `config:"smtp_address" usage:"host:port of the SMTP server mails are sent through, mails are only logged without it"`
+	SMTPUsername string `config:"smtp_username" usage:"user authenticating with the SMTP server"`
+	SMTPPassword string `config:"smtp_password" usage:"password authenticating with the SMTP server"`
+	MailFrom     string `config:"mail_from" usage:"sender of the mails sent to users"`
+
+	RateLimitRegister     RateLimit `config:"rate_limit_register" usage:"registrations allowed per ip, like 5/1m or off"`
+	RateLimitLogin        RateLimit `config:"rate_limit_login" usage:"login attempts allowed per ip, like 10/1m or off"`
+	RateLimitRefreshToken RateLimit `config:"rate_limit_refresh_token" usage:"token refreshes allowed per ip, like 30/1m or off"`
+	RateLimitProfile      RateLimit `config:"rate_limit_profile" usage:"profile requests allowed per user, like 60/1m or off"`
+	RateLimitClient       RateLimit `config:"rate_limit_client" usage:"requests allowed per api client on register and login, like 600/1m or off. The clients sharing basic_token share one limit"`
+
+	PasswordMinLength            int    `config:"password_min_length" usage:"minimum password length"`
+	PasswordMaxLength            int    `config:"password_max_length" usage:"maximum password length in bytes"`
+	PasswordRequireUpper         bool   `config:"password_require_upper" usage:"passwords need an uppercase letter"`
+	PasswordRequireLower         bool   `config:"password_require_lower" usage:"passwords need a lowercase letter"`
+	PasswordRequireDigit         bool   `config:"password_require_digit" usage:"passwords need a digit"`
+	PasswordRequireSymbol        bool   `config:"password_require_symbol" usage:"passwords need a symbol"`
+	PasswordDisallowPersonalInfo bool   `config:"password_disallow_personal_info" usage:"passwords can not be the email or name of the user"`
+	BreachedPasswordsFile        string `config:"breached_passwords_file" usage:"file of breached passwords or SHA-1 hashes, replaces the bundled list"`
+}
+
+// DefaultConfig returns the settings used when nothing else is configured
+func DefaultConfig() Config {
+	policy := DefaultPasswordPolicy()
+	return Config{
+		Address:         "127.0.0.1:8000",
+		ReadTimeout:     10 * time.Second,
+		WriteTimeout:    15 * time.Second,
+		IdleTimeout:     60 * time.Second,
+		DrainDelay:      5 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		LogLevel:        "info",
+		TraceExporter:   traceExporterNone,
+		OTLPEndpoint:    "http://localhost:4318",
+
+		Storage: storageMongo,
+
+		MongoURI:              "mongodb://localhost:27017",
+		Database:              "account",
+		MongoConnectTimeout:   10 * time.Second,
+		MongoOperationTimeout: 5 * time.Second,
+		MongoConnectRetries:   5,
+		MongoRetryBackoff:     time.Second,
+		MongoMaxPoolSize:      100,
+		MigrateOnStart:        true,
+
+		PostgresConnectTimeout:   10 * time.Second,
+		PostgresOperationTimeout: 5 * time.Second,
+		PostgresConnectRetries:   5,
+		PostgresRetryBackoff:     time.Second,
+		PostgresMaxConns:         25,
+
+		SQLitePath:        "account.db",
+		SQLiteBusyTimeout: 5 * time.Second,
+
+		AccessTokenTTL:          15 * time.Minute,
+		RefreshedAccessTokenTTL: 2 * time.Hour,
+		RefreshTokenTTL:         8 * time.Hour,
+		EmailChangeTTL:          24 * time.Hour,
+		BcryptCost:              4,
+		CORSOrigin:              "*",
+		TrustedProxyHops:        1,
+		RequireIfMatch:          true,
+
+		NearbyMaxRadius: 50000,
+
+		EmailLowercaseLocalPart: true,
+
+		PublicURL: "http://127.0.0.1:8000",
+		MailFrom:  "no-reply@localhost",
+
+		RateLimitRegister:     RateLimit{Requests: 5, Period: time.Minute},
+		RateLimitLogin:        RateLimit{Requests: 10, Period: time.Minute},
+		RateLimitRefreshToken: RateLimit{Requests: 30, Period: time.Minute},
+		RateLimitProfile:      RateLimit{Requests: 60, Period: time.Minute},
+		RateLimitClient:       RateLimit{Requests: 600, Period: time.Minute},
+
+		PasswordMinLength:            policy.MinLength,
+		PasswordMaxLength:            policy.MaxLength,
+		PasswordDisallowPersonalInfo: policy.DisallowPersonalInfo,
+	}
+}
+
+// Flag and environment variable naming the config file
+const (
+	configFileFlag = "config"
+	configFileEnv  = "CONFIG_FILE"
+)
+
+// LoadConfig builds the config from, in increasing order of precedence,
+// the defaults, a YAML or TOML config file, environment variables and
+// command line flags. The result is validated. The arguments after the
+// flags, a command and its own arguments, are returned
+func LoadConfig(args []string) (Config, []string, error) {
+	return loadConfig(args, os.LookupEnv)
+}
+
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, []string, error) {
+	cfg := DefaultConfig()
+	fields := configFields(&cfg)
+
+	flags := flag.NewFlagSet("account", flag.ContinueOnError)
+	configFile := flags.String(configFileFlag, "", "YAML or TOML config file, also read from "+configFileEnv)
+	flagValues := make(map[string]*string, len(fields))
+	for _, field := range fields {
+		flagValues[field.key] = flags.String(field.flagName(), "", field.usage+" ("+field.envName()+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+	rest := flags.Args()
+
+	if *configFile == "" {
+		*configFile, _ = lookupEnv(configFileEnv)
+	}
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return cfg, rest, err
+		}
+		for key, value := range values {
+			field, ok := fields[key]
+			if !ok {
+				return cfg, rest, fmt.Errorf("%s: unknown setting %s", *configFile, key)
+			}
+			if err := field.set(value); err != nil {
+				return cfg, rest, fmt.Errorf("%s: %s", *configFile, err)
+			}
+		}
+	}
+
+	for _, field := range fields {
+		if value, ok := lookupEnv(field.envName()); ok {
+			if err := field.set(strings.TrimSpace(value)); err != nil {
+				return cfg, rest, fmt.Errorf("environment variable %s", err)
+			}
+		}
+	}
+
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		for key, field := range fields {
+			if flagErr == nil && f.Name == field.flagName() {
+				if err := field.set(*flagValues[key]); err != nil {
+					flagErr = fmt.Errorf("flag %s", err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return cfg, rest, flagErr
+	}
+
+	return cfg, rest, cfg.Validate()
+}
+
+// Validate reports every setting that is missing or out of range
+func (c Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Address != "", "address is required")
+	check(c.ReadTimeout > 0, "read_timeout should be positive")
+	check(c.WriteTimeout > 0, "write_timeout should be positive")
+	check(c.IdleTimeout > 0, "idle_timeout should be positive")
+	check(c.DrainDelay >= 0, "drain_delay can not be negative")
+	check(c.ShutdownTimeout > 0, "shutdown_timeout should be positive")
+	check(c.TraceExporter == traceExporterNone || c.TraceExporter == traceExporterStdout || c.TraceExporter == traceExporterOTLP,
+		"trace_exporter should be one of none, stdout or otlp")
+	check(c.TraceExporter != traceExporterOTLP || strings.HasPrefix(c.OTLPEndpoint, "http://") || strings.HasPrefix(c.OTLPEndpoint, "https://"),
+		"otlp_endpoint should be an http:// or https:// url")
+	check(new(slog.Level).UnmarshalText([]byte(c.LogLevel)) == nil, "log_level should be one of debug, info, warn or error")
+	check(c.Storage == storageMongo || c.Storage == storagePostgres || c.Storage == storageSQLite || c.Storage == storageMemory,
+		"storage should be one of mongo, postgres, sqlite or memory")
+	if c.Storage == storageMongo {
+		check(strings.HasPrefix(c.MongoURI, "mongodb://") || strings.HasPrefix(c.MongoURI, "mongodb+srv://"),
+			"mongo_uri should start with mongodb:// or mongodb+srv://")
+		check(c.Database != "", "database is required")
+		check(c.MongoConnectTimeout > 0, "mongo_connect_timeout should be positive")
+		check(c.MongoOperationTimeout > 0, "mongo_operation_timeout should be positive")
+		check(c.MongoConnectRetries >= 0, "mongo_connect_retries can not be negative")
+		check(c.MongoRetryBackoff > 0, "mongo_retry_backoff should be positive")
+		check(c.MongoMaxPoolSize == 0 || c.MongoMinPoolSize <= c.MongoMaxPoolSize,
+			"mongo_min_pool_size should not exceed mongo_max_pool_size")
+	}
+	if c.Storage == storagePostgres {
+		check(strings.HasPrefix(c.PostgresURL, "postgres://") || strings.HasPrefix(c.PostgresURL, "postgresql://"),
+			"postgres_url should start with postgres:// or postgresql://")
+		check(c.PostgresConnectTimeout > 0, "postgres_connect_timeout should be positive")
+		check(c.PostgresOperationTimeout > 0, "postgres_operation_timeout should be positive")
+		check(c.PostgresConnectRetries >= 0, "postgres_connect_retries can not be negative")
+		check(c.PostgresRetryBackoff > 0, "postgres_retry_backoff should be positive")
+		check(c.PostgresMaxConns > 0, "postgres_max_conns should be positive")
+	}
+	if c.Storage == storageSQLite {
+		check(c.SQLitePath != "", "sqlite_path is required")
+		check(c.SQLiteBusyTimeout > 0, "sqlite_busy_timeout should be positive")
+	}
+	check(c.SigningKey != "", "signing_key is required")
+	check(c.RefreshSigningKey != "", "refresh_signing_key is required")
+	check(c.SigningKey == "" || c.SigningKey != c.RefreshSigningKey, "signing_key and refresh_signing_key should differ")
+	check(c.BasicToken != "", "basic_token is required")
+	for client, token := range c.ClientTokens {
+		check(token != c.BasicToken, "client_tokens %s should not use basic_token", client)
+	}
+	check(c.AccessTokenTTL > 0, "access_token_ttl should be positive")
+	check(c.RefreshedAccessTokenTTL > 0, "refreshed_access_token_ttl should be positive")
+	check(c.RefreshTokenTTL > 0, "refresh_token_ttl should be positive")
+	check(c.EmailChangeTTL > 0, "email_change_ttl should be positive")
+	check(c.BcryptCost >= bcrypt.MinCost && c.BcryptCost <= bcrypt.MaxCost,
+		"bcrypt_cost should be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	check(c.CORSOrigin != "", "cors_origin is required")
+	check(c.TrustedProxyHops > 0, "trusted_proxy_hops should be positive")
+	check(strings.HasPrefix(c.PublicURL, "http://") || strings.HasPrefix(c.PublicURL, "https://"),
+		"public_url should be an http:// or https:// url")
+	check(c.SMTPAddress == "" || c.MailFrom != "", "mail_from is required to send mails")
+	check(c.NearbyMaxRadius > 0, "nearby_max_radius should be positive")
+	check(c.PhoneDefaultRegion == "" || phonenumbers.GetSupportedRegions()[c.PhoneDefaultRegion],
+		"phone_default_region should be an ISO 3166 country code in upper case like NG")
+
+	if err := c.passwordPolicy(nil).validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// EmailNormalizer returns the normalization applied to emails
+func (c Config) EmailNormalizer() EmailNormalizer {
+	return EmailNormalizer{LowercaseLocalPart: c.EmailLowercaseLocalPart, IDN: c.EmailIDN}
+}
+
+// Returns the password policy the config describes, checking passwords
+// against breached instead of the bundled list when it is not nil
+func (c Config) passwordPolicy(breached *BreachedPasswords) PasswordPolicy {
+	if breached == nil {
+		breached = commonPasswordList
+	}
+	return PasswordPolicy{
+		MinLength:            c.PasswordMinLength,
+		MaxLength:            c.PasswordMaxLength,
+		RequireUpper:         c.PasswordRequireUpper,
+		RequireLower:         c.PasswordRequireLower,
+		RequireDigit:         c.PasswordRequireDigit,
+		RequireSymbol:        c.PasswordRequireSymbol,
+		DisallowPersonalInfo: c.PasswordDisallowPersonalInfo,
+		Breached:             breached,
+	}
+}
+
+// A settable field of a Config
+type configField struct {
+	key   string
+	usage string
+	value reflect.Value
+}
+
+func (f configField) envName() string {
+	return strings.ToUpper(f.key)
+}
+
+func (f configField) flagName() string {
+	return strings.Replace(f.key, "_", "-", -1)
+}
+
+// Parses raw into the field according to its type
+func (f configField) set(raw string) error {
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(raw)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s should be a duration like 15m, got %q", f.key, raw)
+		}
+		f.value.SetInt(int64(d))
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%s should be a number, got %q", f.key, raw)
+		}
+		f.value.SetInt(int64(n))
+	case uint64:
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s should be a positive number, got %q", f.key, raw)
+		}
+		f.value.SetUint(n)
+	case RateLimit:
+		limit, err := ParseRateLimit(raw)
+		if err != nil {
+			return fmt.Errorf("%s %s", f.key, err)
+		}
+		f.value.Set(reflect.ValueOf(limit))
+	case ClientTokens:
+		clients, err := ParseClientTokens(raw)
+		if err != nil {
+			return fmt.Errorf("%s %s", f.key, err)
+		}
+		f.value.Set(reflect.ValueOf(clients))
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s should be true or false, got %q", f.key, raw)
+		}
+		f.value.SetBool(b)
+	default:
+		return fmt.Errorf("%s has an unsupported type", f.key)
+	}
+	return nil
+}
+
+// Returns the settable fields of a config keyed by their config tag
+func configFields(cfg *Config) map[string]configField {
+	v := reflect.ValueOf(cfg).Elem()
+	fields := make(map[string]configField, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag
+		key := tag.Get("config")
+		fields[key] = configField{key: key, usage: tag.Get("usage"), value: v.Field(i)}
+	}
+	return fields
+}
+
+// Reads the settings of a YAML or TOML config file as strings
+func readConfigFile(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file, %w", err)
+	}
+
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &raw)
+	case ".toml":
+		err = toml.Unmarshal(content, &raw)
+	default:
+		return nil, fmt.Errorf("config file %s should be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file %s, %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		values[key] = fmt.Sprint(value)
+	}
+	return values, nil
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator"
+	"github.com/nyaruka/phonenumbers"
+)
+
+// Address is the postal address of a user
+type Address struct {
+	Lines      []string `json:"lines" bson:"lines" validate:"max=3,dive,max=100"`
+	City       string   `json:"city" bson:"city" validate:"max=100"`
+	Region     string   `json:"region" bson:"region" validate:"max=100"`
+	PostalCode string   `json:"postal_code" bson:"postal_code" validate:"max=20"`
+
+	// ISO 3166-1 alpha-2 code, like NG
+	Country string `json:"country" bson:"country" validate:"omitempty,country_code"`
+}
+
+// Returns the address trimmed with its country code in upper case, nil when
+// it is empty
+func (a *Address) normalized() *Address {
+	if a == nil {
+		return nil
+	}
+	normalized := Address{
+		City:       strings.TrimSpace(a.City),
+		Region:     strings.TrimSpace(a.Region),
+		PostalCode: strings.TrimSpace(a.PostalCode),
+		Country:    strings.ToUpper(strings.TrimSpace(a.Country)),
+	}
+	for _, line := range a.Lines {
+		if line = strings.TrimSpace(line); line != "" {
+			normalized.Lines = append(normalized.Lines, line)
+		}
+	}
+	if reflect.DeepEqual(normalized, Address{}) {
+		return nil
+	}
+	return &normalized
+}
+
+// Returns the address on one line, the way user_address held it
+func (a *Address) String() string {
+	if a == nil {
+		return ""
+	}
+	parts := append([]string{}, a.Lines...)
+	for _, part := range []string{a.City, a.Region, a.PostalCode, a.Country} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Checks that a country code is one phone numbers are known for, which
+// covers the ISO 3166-1 countries
+func isCountryCode(fl validator.FieldLevel) bool {
+	code := fl.Field().String()
+	return code == strings.ToUpper(code) && phonenumbers.GetSupportedRegions()[code]
+}
+
+// Reads a one line address like "1 Marina, Lagos, NG": the last part is the
+// country when it is a country code, the one before it the city and the
+// others the lines. An address without at least a line and a city does not
+// parse
+func parseLegacyAddress(raw string) (*Address, bool) {
+	var parts []string
+	for _, part := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	var address Address
+	if n := len(parts); n > 0 && len(parts[n-1]) == 2 {
+		if code := strings.ToUpper(parts[n-1]); phonenumbers.GetSupportedRegions()[code] {
+			address.Country = code
+			parts = parts[:n-1]
+		}
+	}
+	if len(parts) < 2 {
+		return nil, false
+	}
+	address.City = parts[len(parts)-1]
+	address.Lines = parts[:len(parts)-1]
+	if validate.Struct(address) != nil {
+		return nil, false
+	}
+	return &address, true
+}
+
+// Returns a phone number in E.164. A number without its country code is
+// read as a number of region, it does not parse without one
+func normalizePhone(raw, region string) (string, bool) {
+	number, err := phonenumbers.Parse(raw, region)
+	if err != nil || !phonenumbers.IsValidNumber(number) {
+		return "", false
+	}
+	return phonenumbers.Format(number, phonenumbers.E164), true
+}
+
+// Country phone numbers of a user without their country code are read in
+func phoneRegion(address *Address, defaultRegion string) string {
+	if address != nil && address.Country != "" {
+		return address.Country
+	}
+	return defaultRegion
+}
+
+// legacyContact is the phone number and address of a user stored before
+// they were structured, converted where they parse
+type legacyContact struct {
+	phone   string
+	address *Address
+
+	// the values that did not parse, keyed by field
+	unparsed map[string]string
+}
+
+// Converts the phone number and one line address of a user. A phone number
+// without its country code parses in the country of the address
+func convertLegacyContact(phone, userAddress string) legacyContact {
+	var contact legacyContact
+	unparsed := make(map[string]string)
+
+	if userAddress != "" {
+		if address, ok := parseLegacyAddress(userAddress); ok {
+			contact.address = address
+		} else {
+			unparsed["user_address"] = userAddress
+		}
+	}
+	if phone != "" {
+		if normalized, ok := normalizePhone(phone, phoneRegion(contact.address, "")); ok {
+			contact.phone = normalized
+		} else {
+			unparsed["phone_number"] = phone
+		}
+	}
+
+	if len(unparsed) > 0 {
+		contact.unparsed = unparsed
+	}
+	return contact
+}
+
+// Keeps the address of a profile replaced by an older client, which sends
+// back the user_address it was given instead of the address. Only called
+// when the body has no address, a null address clears it
+func (p *profileUpdate) keepLegacyAddress(current profileUpdate) {
+	if p.Address == nil && p.UserAddress != "" && p.UserAddress == current.UserAddress {
+		p.Address = current.Address
+	}
+}
+
+// Normalizes a profile about to replace current. A changed phone number is
+// read in the country of the address and written in E.164, and the fields
+// derived from the others are set: user_address is the address on one line
+// for older clients, and a field leaves unparsed once it is updated. A
+// user_address changed by an older client without an address is parsed
+// into the address, or kept unparsed
+func (p *profileUpdate) normalize(current profileUpdate, defaultRegion string) error {
+	legacyAddress := ""
+	if p.Address == nil && p.UserAddress != "" && p.UserAddress != current.UserAddress {
+		if address, ok := parseLegacyAddress(p.UserAddress); ok {
+			p.Address = address
+		} else {
+			legacyAddress = p.UserAddress
+		}
+	}
+
+	p.Address = p.Address.normalized()
+	addressChanged := !reflect.DeepEqual(p.Address, current.Address) || legacyAddress != ""
+	phoneChanged := p.PhoneNumber != current.PhoneNumber
+
+	p.UserAddress = current.UserAddress
+	if addressChanged {
+		p.UserAddress = p.Address.String()
+	}
+
+	p.Unparsed = nil
+	for name, value := range current.Unparsed {
+		if (name == "user_address" && addressChanged) || (name == "phone_number" && phoneChanged) {
+			continue
+		}
+		if p.Unparsed == nil {
+			p.Unparsed = make(map[string]string)
+		}
+		p.Unparsed[name] = value
+	}
+	if legacyAddress != "" {
+		if p.Unparsed == nil {
+			p.Unparsed = make(map[string]string)
+		}
+		p.UserAddress = legacyAddress
+		p.Unparsed["user_address"] = legacyAddress
+	}
+
+	if phoneChanged && p.PhoneNumber != "" {
+		normalized, ok := normalizePhone(p.PhoneNumber, phoneRegion(p.Address, defaultRegion))
+		if !ok {
+			apiErr := newAPIError(http.StatusBadRequest, CodeValidationFailed, "Invalid Payload")
+			apiErr.Fields = map[string]FieldError{"phone_number": newFieldError("phone", "field.phone", "phone_number")}
+			apiErr.Message = apiErr.Fields["phone_number"].Message
+			return apiErr
+		}
+		p.PhoneNumber = normalized
+	}
+	return nil
+}
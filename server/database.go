@@ -2,31 +2,248 @@ package server
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-// Connect to a local db instance
-func connectDB() *mongo.Client {
+// Collection holding the users
+const usersCollection = "user"
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// Emails are compared ignoring case, so the unique index and the queries
+// using it share this collation
+var emailCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// Database is a connection to the mongo database holding the accounts
+type Database struct {
+	client *mongo.Client
+	db     *mongo.Database
+
+	// maximum duration of a single storage operation
+	timeout time.Duration
+}
+
+// ConnectDatabase connects to the configured mongo instance. Failed attempts
+// are retried with exponential backoff until the configured number of
+// retries is used up or ctx is done
+func ConnectDatabase(ctx context.Context, cfg Config, logger *slog.Logger) (*Database, error) {
+	opts := options.Client().
+		ApplyURI(cfg.MongoURI).
+		SetConnectTimeout(cfg.MongoConnectTimeout).
+		SetServerSelectionTimeout(cfg.MongoConnectTimeout).
+		SetMaxPoolSize(cfg.MongoMaxPoolSize).
+		SetMinPoolSize(cfg.MongoMinPoolSize)
+
+	var client *mongo.Client
+	err := connectWithRetries(ctx, logger, cfg.MongoConnectRetries, cfg.MongoRetryBackoff, func() (err error) {
+		client, err = connectDB(ctx, opts, cfg.MongoConnectTimeout)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Connected to MongoDB", "database", cfg.Database)
+	return &Database{
+		client:  client,
+		db:      client.Database(cfg.Database),
+		timeout: cfg.MongoOperationTimeout,
+	}, nil
+}
+
+// Makes a single attempt at connecting to and pinging mongo
+func connectDB(ctx context.Context, opts *options.ClientOptions, timeout time.Duration) (*mongo.Client, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	client, err := mongo.Connect(ctx, opts)
 	if err != nil {
-		log.Fatal("Error in connecting to db")
+		return nil, fmt.Errorf("Error in connecting to db, %w", err)
 	}
 
 	err = client.Ping(ctx, readpref.Primary())
 	if err != nil {
-		log.Fatalln("Could not ping db with error", err)
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("Could not ping db with error, %w", err)
+	}
+	return client, nil
+}
+
+// Ping checks that the database can be reached
+func (d *Database) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.client.Ping(ctx, readpref.Primary())
+}
+
+// Disconnect closes every connection to the database
+func (d *Database) Disconnect(ctx context.Context) error {
+	return d.client.Disconnect(ctx)
+}
+
+// Sets and unsets the changed profile fields of a user, found by id and
+// version
+func (d *Database) patchUser(ctx context.Context, id string, version int64, patch userPatch) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	update := bson.M{"$inc": bson.M{"version": 1}}
+	if len(patch.set) > 0 {
+		set := bson.M{}
+		for name, value := range patch.set {
+			field, _ := lookupProfileField(name)
+			set[field.bson] = value
+		}
+		update["$set"] = set
+	}
+	if len(patch.unset) > 0 {
+		unset := bson.M{}
+		for _, name := range patch.unset {
+			field, _ := lookupProfileField(name)
+			unset[field.bson] = ""
+		}
+		update["$unset"] = unset
+	}
+
+	result, err := d.db.Collection(usersCollection).UpdateOne(ctx, bson.M{"id": id, "version": version}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return d.missedUpdate(ctx, id)
+	}
+	return nil
+}
+
+// Returns the discoverable users within radius meters of center, nearest
+// first. The query needs the 2dsphere index on location
+func (d *Database) nearbyUsers(ctx context.Context, center GeoPoint, radius float64, limit int, exclude string) ([]User, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	filter := bson.M{
+		"location": bson.M{"$nearSphere": bson.M{
+			"$geometry":    center,
+			"$maxDistance": radius,
+		}},
+		"discoverable": true,
+		"id":           bson.M{"$ne": exclude},
+	}
+	cursor, err := d.db.Collection(usersCollection).Find(ctx, filter, options.Find().SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
 	}
-	log.Println("Connected to MongoDB")
-	return client
+	return users, nil
 }
 
-var Client = connectDB()
+// Tells why an update of the user with id matched nothing, the user is gone
+// or it has another version
+func (d *Database) missedUpdate(ctx context.Context, id string) error {
+	count, err := d.db.Collection(usersCollection).CountDocuments(ctx, bson.M{"id": id})
+	if err != nil {
+		return err
+	} else if count == 0 {
+		return errUserNotFound
+	}
+	return errVersionConflict
+}
+
+// Checks if a write failed because it broke a unique index
+func isDuplicateKeyError(err error) bool {
+	duplicateKey := func(code int) bool {
+		return code == 11000 || code == 11001 || code == 12582
+	}
+
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, e := range writeErr.WriteErrors {
+			if duplicateKey(e.Code) {
+				return true
+			}
+		}
+	}
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) {
+		return duplicateKey(int(commandErr.Code))
+	}
+	return false
+}
+
+// Add User to MongoDB. The unique index on email rejects a user that
+// already exists, even when registered concurrently
+func (d *Database) addUser(ctx context.Context, userDetails User) error {
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	_, err := d.db.Collection(usersCollection).InsertOne(ctx, userDetails)
+	if isDuplicateKeyError(err) {
+		return errUserExists
+	}
+	return err
+}
+
+// Retrieve User from MongoDB
+func (d *Database) getUser(ctx context.Context, email string) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	collection := d.db.Collection(usersCollection)
+
+	// check if user exists
+	var userDetails User
+	filter := bson.M{"email": email}
+	err := collection.FindOne(ctx, filter, options.FindOne().SetCollation(emailCollation)).Decode(&userDetails)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return User{}, errUserNotFound
+	} else if err != nil {
+		return User{}, err
+	}
+	return userDetails, nil
+}
+
+// Retrieve User from MongoDB by id
+func (d *Database) getUserByID(ctx context.Context, id string) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	var userDetails User
+	err := d.db.Collection(usersCollection).FindOne(ctx, bson.M{"id": id}).Decode(&userDetails)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return User{}, errUserNotFound
+	} else if err != nil {
+		return User{}, err
+	}
+	return userDetails, nil
+}
+
+// update details of a user, found by id and version
+func (d *Database) updateUser(ctx context.Context, user User) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	collection := d.db.Collection(usersCollection)
+	filter := bson.M{"id": user.ID, "version": user.Version}
+	user.Version++
+	update := bson.M{"$set": user}
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if isDuplicateKeyError(err) {
+		return errUserExists
+	} else if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return d.missedUpdate(ctx, user.ID)
+	}
+	return nil
+}
@@ -0,0 +1,402 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Environment variable pointing the storage tests at a MongoDB instance
+const testMongoURIEnv = "ACCOUNT_TEST_MONGO_URI"
+
+// Connects to a fresh database of the MongoDB instance the tests are pointed
+// at, skipping the test when there is none. The database is dropped after
+func newTestDatabase(t *testing.T) (*Database, Config) {
+	uri := os.Getenv(testMongoURIEnv)
+	if uri == "" {
+		t.Skipf("%s is not set", testMongoURIEnv)
+	}
+
+	cfg := DefaultConfig()
+	cfg.MongoURI = uri
+	cfg.Database = fmt.Sprintf("account_test_%d", time.Now().UnixNano())
+	cfg.MongoConnectRetries = 0
+	cfg.SigningKey = "test-signing-key"
+	cfg.RefreshSigningKey = "test-refresh-signing-key"
+	cfg.BasicToken = "test-basic-token"
+
+	db, err := ConnectDatabase(context.Background(), cfg, NewLogger(io.Discard, "error"))
+	if err != nil {
+		t.Fatal("Could not connect to test database with error ", err)
+	}
+	t.Cleanup(func() {
+		db.db.Drop(context.Background())
+		db.Disconnect(context.Background())
+	})
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatal("Could not migrate test database with error ", err)
+	}
+	return db, cfg
+}
+
+func TestIsDuplicateKeyError(t *testing.T) {
+	duplicate := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "E11000 duplicate key error"}}}
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{duplicate, true},
+		{fmt.Errorf("wrapped, %w", duplicate), true},
+		{mongo.CommandError{Code: 11000}, true},
+		{mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 121}}}, false},
+		{errors.New("connection reset"), false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if got := isDuplicateKeyError(c.err); got != c.want {
+			t.Errorf("Expected isDuplicateKeyError(%v) to be %v", c.err, c.want)
+		}
+	}
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	db, cfg := newTestDatabase(t)
+	cfg.RateLimitRegister = RateLimit{}
+	cfg.RateLimitClient = RateLimit{}
+	s, err := NewServer(cfg, db, nil)
+	if err != nil {
+		t.Fatal("Could not create server with error ", err)
+	}
+	router := s.Router()
+
+	// The same email in different cases, registered at the same time
+	emails := []string{"racer@example.com", "Racer@example.com", "RACER@EXAMPLE.COM"}
+	const attempts = 12
+	statuses := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(email string) {
+			defer wg.Done()
+			body := `{"email":"` + email + `","password":"c0rrect-Horse-battery","confirm_password":"c0rrect-Horse-battery"}`
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/register", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer test-basic-token")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			statuses <- rr.Code
+		}(emails[i%len(emails)])
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusConflict] != attempts-1 {
+		t.Errorf("Expected one registration and %d conflicts, got %v", attempts-1, counts)
+	}
+
+	n, err := db.db.Collection(usersCollection).CountDocuments(context.Background(), bson.M{})
+	if err != nil || n != 1 {
+		t.Errorf("Expected one stored user, got %d, %v", n, err)
+	}
+}
+
+func TestNormalizeEmails(t *testing.T) {
+	db, _ := newTestDatabase(t)
+	ctx := context.Background()
+
+	// Collisions can only exist in data stored before the unique index
+	db.db.Collection(usersCollection).Indexes().DropAll(ctx)
+	for _, email := range []string{"Uche@Gmail.com", "uche@gmail.COM", "Ada@Example.com", "bob@example.com"} {
+		if _, err := db.db.Collection(usersCollection).InsertOne(ctx, User{Email: email}); err != nil {
+			t.Fatal("Could not insert user with error ", err)
+		}
+	}
+
+	normalizer := EmailNormalizer{LowercaseLocalPart: true}
+	report, err := db.NormalizeEmails(ctx, normalizer, true)
+	if err != nil {
+		t.Fatal("Could not normalize emails with error ", err)
+	}
+	stored := func(email string) int64 {
+		n, _ := db.db.Collection(usersCollection).CountDocuments(ctx, bson.M{"email": email})
+		return n
+	}
+	if report.Normalized != 1 || stored("Ada@Example.com") != 1 {
+		t.Errorf("Expected a dry run to report without writing, got %+v", report)
+	}
+
+	report, err = db.NormalizeEmails(ctx, normalizer, false)
+	if err != nil {
+		t.Fatal("Could not normalize emails with error ", err)
+	}
+	if report.Scanned != 4 || report.Normalized != 1 || len(report.Collisions) != 1 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	if collision := report.Collisions[0]; collision.Email != "uche@gmail.com" || len(collision.Stored) != 2 {
+		t.Errorf("Unexpected collision %+v", collision)
+	}
+	if stored("ada@example.com") != 1 || stored("Uche@Gmail.com") != 1 {
+		t.Errorf("Expected ada@example.com to be normalized and collisions left untouched")
+	}
+}
+
+func TestBackfillUserIDs(t *testing.T) {
+	db, _ := newTestDatabase(t)
+	ctx := context.Background()
+
+	if _, err := db.db.Collection(usersCollection).InsertOne(ctx, bson.M{"email": "old@example.com"}); err != nil {
+		t.Fatal("Could not insert user with error ", err)
+	}
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatal("Could not migrate with error ", err)
+	}
+
+	user, err := db.getUser(ctx, "old@example.com")
+	if err != nil || user.ID == "" {
+		t.Fatalf("Expected the user to get an id, got %+v, %v", user, err)
+	}
+	if byID, err := db.getUserByID(ctx, user.ID); err != nil || byID.Email != user.Email {
+		t.Errorf("Expected to find the user by id, got %+v, %v", byID, err)
+	}
+}
+
+// Mailer keeping the mails it is asked to send
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestChangeEmail(t *testing.T) {
+	db, cfg := newTestDatabase(t)
+	s, err := NewServer(cfg, db, nil)
+	if err != nil {
+		t.Fatal("Could not create server with error ", err)
+	}
+	mailer := &recordingMailer{}
+	s.UseMailer(mailer)
+	router := s.Router()
+	ctx := context.Background()
+
+	hash, _ := HashPassword("c0rrect-Horse-battery", cfg.BcryptCost)
+	user := User{ID: newUserID(), Email: "old@example.com", HashedPassword: hash}
+	taken := User{ID: newUserID(), Email: "taken@example.com", HashedPassword: hash}
+	for _, u := range []User{user, taken} {
+		if err := db.addUser(ctx, u); err != nil {
+			t.Fatal("Could not add user with error ", err)
+		}
+	}
+	accessToken, _, _ := s.tokens.GenerateToken(user.ID)
+
+	request := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/profile/email", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := request(`{"current_password":"wrong","new_email":"new@example.com"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a wrong password to be rejected, got %v", rr.Code)
+	}
+	if rr := request(`{"current_password":"c0rrect-Horse-battery","new_email":"Taken@example.com"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected an email in use to be rejected, got %v", rr.Code)
+	}
+	if rr := request(`{"current_password":"c0rrect-Horse-battery","new_email":"New@Example.com"}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the change to be requested, got %v %s", rr.Code, rr.Body.String())
+	}
+
+	if len(mailer.sent) != 2 || mailer.sent[0].To != "new@example.com" || mailer.sent[1].To != "old@example.com" {
+		t.Fatalf("Expected a confirmation to the new email and a notice to the old one, got %+v", mailer.sent)
+	}
+	if stored, _ := db.getUserByID(ctx, user.ID); stored.Email != "old@example.com" {
+		t.Errorf("Expected the email to change only once confirmed, got %s", stored.Email)
+	}
+
+	body := mailer.sent[0].Body
+	link := strings.TrimSpace(body[strings.Index(body, cfg.PublicURL):])
+	show := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, strings.TrimPrefix(link, cfg.PublicURL), nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := show()
+	var shown struct {
+		Data pendingEmailChange `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &shown)
+	if rr.Code != http.StatusOK || shown.Data.NewEmail != "new@example.com" || shown.Data.Token == "" {
+		t.Fatalf("Expected the link to show the change, got %v %s", rr.Code, rr.Body.String())
+	}
+	if stored, _ := db.getUserByID(ctx, user.ID); stored.Email != "old@example.com" {
+		t.Errorf("Expected opening the link to leave the email alone, got %s", stored.Email)
+	}
+
+	confirm := func() int {
+		body := `{"token":"` + shown.Data.Token + `"}`
+		req := httptest.NewRequest(http.MethodPost, apiV1Prefix+emailConfirmPath, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := confirm(); code != http.StatusOK {
+		t.Fatalf("Expected the token to confirm the change, got %v", code)
+	}
+	if stored, _ := db.getUserByID(ctx, user.ID); stored.Email != "new@example.com" {
+		t.Errorf("Expected the email to change, got %s", stored.Email)
+	}
+	if code := confirm(); code != http.StatusBadRequest {
+		t.Errorf("Expected the token to work once, got %v", code)
+	}
+	if rr := show(); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected the link to be invalid once used, got %v", rr.Code)
+	}
+}
+
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range migrations {
+		if m.name == "" || m.up == nil {
+			t.Errorf("Expected migration %d to have a name and an up", m.version)
+		}
+		if i > 0 && m.version <= migrations[i-1].version {
+			t.Errorf("Expected migration %d to come after migration %d", m.version, migrations[i-1].version)
+		}
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	db, _ := newTestDatabase(t)
+	ctx := context.Background()
+
+	statuses, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal("Could not get migration status with error ", err)
+	}
+	if len(statuses) != len(migrations) {
+		t.Fatalf("Expected the status of %d migrations, got %d", len(migrations), len(statuses))
+	}
+	for _, status := range statuses {
+		if !status.Applied || status.AppliedAt.IsZero() {
+			t.Errorf("Expected migration %d %s to be applied", status.Version, status.Name)
+		}
+	}
+
+	// applying again is a no-op
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatal("Could not migrate again with error ", err)
+	}
+
+	// back to before the id index, the third migration
+	if err := db.Rollback(ctx, len(migrations)-2); err != nil {
+		t.Fatal("Could not roll back with error ", err)
+	}
+	statuses, _ = db.MigrationStatus(ctx)
+	last := statuses[len(statuses)-1]
+	if last.Applied {
+		t.Errorf("Expected migration %d %s to be rolled back", last.Version, last.Name)
+	}
+	cursor, err := db.db.Collection(usersCollection).Indexes().List(ctx)
+	if err != nil {
+		t.Fatal("Could not list indexes with error ", err)
+	}
+	var indexes []struct {
+		Name string `bson:"name"`
+	}
+	if err := cursor.All(ctx, &indexes); err != nil {
+		t.Fatal("Could not read indexes with error ", err)
+	}
+	for _, index := range indexes {
+		if index.Name == "id_unique" {
+			t.Error("Expected the id index to be dropped on rollback")
+		}
+	}
+
+	// the backfill can not be undone
+	if err := db.Rollback(ctx, 1); err == nil {
+		t.Error("Expected rolling back an irreversible migration to fail")
+	}
+
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatal("Could not re-apply migrations with error ", err)
+	}
+	statuses, _ = db.MigrationStatus(ctx)
+	if !statuses[len(statuses)-1].Applied {
+		t.Error("Expected the rolled back migration to be applied again")
+	}
+}
+
+func TestMigrationLock(t *testing.T) {
+	db, _ := newTestDatabase(t)
+	ctx := context.Background()
+
+	locked, err := db.tryMigrationLock(ctx, "other-runner")
+	if err != nil || !locked {
+		t.Fatal("Could not take the migration lock with error ", err)
+	}
+
+	waiting, cancel := context.WithTimeout(ctx, 2*migrationLockPoll)
+	defer cancel()
+	if err := db.Migrate(waiting); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected migrating to wait for the held lock, got %v", err)
+	}
+
+	// a lock left by a dead runner is taken over
+	_, err = db.db.Collection(migrationLockCollection).UpdateOne(ctx,
+		bson.M{"_id": "lock"}, bson.M{"$set": bson.M{"expires_at": time.Now().Add(-time.Minute)}})
+	if err != nil {
+		t.Fatal("Could not expire the lock with error ", err)
+	}
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatal("Expected an expired lock to be taken over, got ", err)
+	}
+	count, _ := db.db.Collection(migrationLockCollection).CountDocuments(ctx, bson.M{})
+	if count != 0 {
+		t.Error("Expected the lock to be released after migrating")
+	}
+
+	// the holder renews the lock, and stops once another runner took it over
+	if locked, err := db.tryMigrationLock(ctx, "runner"); err != nil || !locked {
+		t.Fatal("Could not take the migration lock with error ", err)
+	}
+	runCtx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+	go db.renewMigrationLock(runCtx, "runner", 10*time.Millisecond, abort)
+	time.Sleep(50 * time.Millisecond)
+	if runCtx.Err() != nil {
+		t.Fatal("Expected the lock to be renewed while held, got ", context.Cause(runCtx))
+	}
+	_, err = db.db.Collection(migrationLockCollection).UpdateOne(ctx,
+		bson.M{"_id": "lock"}, bson.M{"$set": bson.M{"owner": "other-runner"}})
+	if err != nil {
+		t.Fatal("Could not take the lock over with error ", err)
+	}
+	select {
+	case <-runCtx.Done():
+		if cause := context.Cause(runCtx); !errors.Is(cause, errMigrationLockLost) {
+			t.Errorf("Expected errMigrationLockLost, got %v", cause)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the runner to stop once its lock was taken over")
+	}
+}
@@ -0,0 +1,64 @@
+// Renders the operations of the OpenAPI description served by the api
+(function () {
+  function resolve(spec, schema) {
+    if (schema && schema.$ref) {
+      return resolve(spec, spec.components.schemas[schema.$ref.split("/").pop()]);
+    }
+    if (schema && schema.properties) {
+      var out = {};
+      Object.keys(schema.properties).forEach(function (name) {
+        out[name] = resolve(spec, schema.properties[name]);
+      });
+      return out;
+    }
+    if (schema && schema.type === "array") {
+      return [resolve(spec, schema.items)];
+    }
+    return schema && schema.type ? schema.type + (schema.format ? " (" + schema.format + ")" : "") : "any";
+  }
+
+  function section(title, value) {
+    var h = document.createElement("h4");
+    h.textContent = title;
+    var pre = document.createElement("pre");
+    pre.textContent = JSON.stringify(value, null, 2);
+    return [h, pre];
+  }
+
+  fetch("../openapi.json")
+    .then(function (resp) { return resp.json(); })
+    .then(function (spec) {
+      document.getElementById("title").textContent = spec.info.title + " " + spec.info.version;
+      document.getElementById("description").textContent = spec.info.description;
+
+      var container = document.getElementById("operations");
+      Object.keys(spec.paths).sort().forEach(function (path) {
+        Object.keys(spec.paths[path]).forEach(function (method) {
+          var op = spec.paths[path][method];
+          var details = document.createElement("details");
+          if (op.deprecated) details.className = "deprecated";
+
+          var summary = document.createElement("summary");
+          summary.innerHTML = '<span class="method ' + method + '">' + method + "</span> ";
+          summary.appendChild(document.createTextNode(path + " " + op.summary));
+          details.appendChild(summary);
+
+          var body = document.createElement("div");
+          body.className = "body";
+          if (op.security) {
+            body.appendChild(document.createTextNode("Auth: " + Object.keys(op.security[0]).join(", ")));
+          }
+          if (op.requestBody) {
+            section("Request", resolve(spec, op.requestBody.content["application/json"].schema))
+              .forEach(function (el) { body.appendChild(el); });
+          }
+          section("Response", resolve(spec, op.responses["200"].content["application/json"].schema))
+            .forEach(function (el) { body.appendChild(el); });
+          section("Errors", Object.keys(op.responses).filter(function (s) { return s !== "200"; }))
+            .forEach(function (el) { body.appendChild(el); });
+          details.appendChild(body);
+          container.appendChild(details);
+        });
+      });
+    });
+})();
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/idna"
+)
+
+// EmailNormalizer puts emails in the canonical form they are stored and
+// looked up in. Surrounding spaces are trimmed and the domain lowercased,
+// the local part is lowercased too unless the config keeps its case
+type EmailNormalizer struct {
+	LowercaseLocalPart bool
+
+	// convert internationalized domains to their ascii (punycode) form
+	IDN bool
+}
+
+// Normalize returns the canonical form of an email. Emails without a
+// domain are only trimmed, validation rejects them
+func (n EmailNormalizer) Normalize(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+
+	local, domain := email[:at], strings.ToLower(email[at+1:])
+	if n.LowercaseLocalPart {
+		local = strings.ToLower(local)
+	}
+	if n.IDN {
+		if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+			domain = ascii
+		}
+	}
+	return local + "@" + domain
+}
+
+// EmailCollision is a set of stored users whose emails normalize to the same
+// email. They have to be merged or renamed by hand
+type EmailCollision struct {
+	Email  string
+	Stored []string
+}
+
+// EmailNormalizationReport is the outcome of normalizing the stored emails
+type EmailNormalizationReport struct {
+	Scanned    int
+	Normalized int
+	Collisions []EmailCollision
+}
+
+// NormalizeEmails rewrites every stored email to its canonical form and
+// reports the emails that collide once normalized, which are left untouched.
+// With dryRun nothing is written, the report says what would be
+func (d *Database) NormalizeEmails(ctx context.Context, normalizer EmailNormalizer, dryRun bool) (EmailNormalizationReport, error) {
+	collection := d.db.Collection(usersCollection)
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"email": 1}))
+	if err != nil {
+		return EmailNormalizationReport{}, err
+	}
+	var stored []struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		Email string             `bson:"email"`
+	}
+	if err := cursor.All(ctx, &stored); err != nil {
+		return EmailNormalizationReport{}, err
+	}
+
+	emails := make([]string, len(stored))
+	for i, user := range stored {
+		emails[i] = user.Email
+	}
+	report, changes := planEmailNormalization(emails, normalizer)
+	if dryRun {
+		return report, nil
+	}
+	for i, email := range changes {
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": stored[i].ID}, bson.M{"$set": bson.M{"email": email}, "$inc": bson.M{"version": 1}})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// Works out how normalizing the stored emails changes them. Returns the
+// report and the normalized emails to write, keyed by their index in
+// emails. Emails that collide once normalized are reported and left as is
+func planEmailNormalization(emails []string, normalizer EmailNormalizer) (EmailNormalizationReport, map[int]string) {
+	report := EmailNormalizationReport{Scanned: len(emails)}
+	changes := make(map[int]string)
+
+	groups := make(map[string][]int)
+	for i, email := range emails {
+		normalized := normalizer.Normalize(email)
+		groups[normalized] = append(groups[normalized], i)
+	}
+
+	for email, users := range groups {
+		if len(users) > 1 {
+			collision := EmailCollision{Email: email}
+			for _, i := range users {
+				collision.Stored = append(collision.Stored, emails[i])
+			}
+			sort.Strings(collision.Stored)
+			report.Collisions = append(report.Collisions, collision)
+			continue
+		}
+
+		if i := users[0]; emails[i] != email {
+			changes[i] = email
+		}
+	}
+	report.Normalized = len(changes)
+
+	sort.Slice(report.Collisions, func(i, j int) bool {
+		return report.Collisions[i].Email < report.Collisions[j].Email
+	})
+	return report, changes
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Path, relative to the version prefix, of the link confirming an email change
+const emailConfirmPath = "/profile/email/confirm"
+
+type emailChange struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewEmail        string `json:"new_email" validate:"required,email"`
+}
+
+type emailConfirmation struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// Claims of the token confirming an email change. The token is only valid
+// while the user is still at the version it was issued for, so it can be
+// used once and no longer once the profile changed
+type emailChangeClaims struct {
+	Email    string `json:"email"`
+	NewEmail string `json:"new_email"`
+	Version  int64  `json:"version"`
+	jwt.StandardClaims
+}
+
+// Key email change tokens are signed with, derived from the signing key so
+// they can never pass as access tokens
+func (t tokenIssuer) emailChangeKey() []byte {
+	mac := hmac.New(sha256.New, t.signingKey)
+	mac.Write([]byte("email-change"))
+	return mac.Sum(nil)
+}
+
+// Creates the token confirming that a user changes email
+func (t tokenIssuer) newEmailChangeToken(user User, newEmail string) (string, error) {
+	claims := emailChangeClaims{
+		Email:    user.Email,
+		NewEmail: newEmail,
+		Version:  user.Version,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   user.ID,
+			ExpiresAt: time.Now().Add(t.emailChangeTTL).Unix(),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(t.emailChangeKey())
+}
+
+// Checks a token confirming an email change, returning its claims
+func (t tokenIssuer) checkEmailChangeToken(token string) (emailChangeClaims, error) {
+	var claims emailChangeClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("An error occurred")
+		}
+		return t.emailChangeKey(), nil
+	})
+	if err != nil {
+		return emailChangeClaims{}, err
+	}
+	if claims.Subject == "" || claims.NewEmail == "" {
+		return emailChangeClaims{}, errors.New("Credentials not provided")
+	}
+	return claims, nil
+}
+
+// Endpoint to request a change of the email of the logged in user. A link
+// confirming the change is sent to the new email and a notice to the current
+// one, the email only changes once the link is used
+func (s *Server) ChangeEmail(w http.ResponseWriter, req *http.Request) {
+	const userKey Key = "user"
+	user, ok := req.Context().Value(userKey).(User)
+	if !ok {
+		InternalIssues(w, req)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+
+		var payload emailChange
+		err := json.NewDecoder(req.Body).Decode(&payload)
+		if err != nil {
+			InvalidJsonResp(w, req, err)
+			return
+		}
+		payload.NewEmail = s.emails.Normalize(payload.NewEmail)
+
+		err = validateInput(payload)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+
+		err = s.checkPassword(req.Context(), payload.CurrentPassword, user.HashedPassword)
+		if err != nil {
+			writeError(w, req, newAPIError(http.StatusBadRequest, CodeIncorrectPassword, "Current password is incorrect"))
+			return
+		}
+
+		if payload.NewEmail == user.Email {
+			writeError(w, req, newAPIError(http.StatusBadRequest, CodeEmailUnchanged, "New email is the current email"))
+			return
+		}
+		_, err = s.getUser(req.Context(), payload.NewEmail)
+		if err == nil {
+			writeError(w, req, newAPIError(http.StatusConflict, CodeEmailInUse, "Email is already in use"))
+			return
+		} else if !errors.Is(err, errUserNotFound) {
+			writeError(w, req, err)
+			return
+		}
+
+		token, err := s.tokens.newEmailChangeToken(user, payload.NewEmail)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		link := s.cfg.PublicURL + apiV1Prefix + emailConfirmPath + "?token=" + url.QueryEscape(token)
+
+		err = s.mailer.Send(req.Context(), Message{
+			To:      payload.NewEmail,
+			Subject: "Confirm your new email",
+			Body: "Use the link below to confirm that this is your new email. " +
+				"It expires in " + s.cfg.EmailChangeTTL.String() + ".\n\n" + link + "\n",
+		})
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		err = s.mailer.Send(req.Context(), Message{
+			To:      user.Email,
+			Subject: "Your email is being changed",
+			Body: "A change of the email of your account to " + payload.NewEmail + " was requested. " +
+				"If this was not you, change your password now.\n",
+		})
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+
+		successResp := SuccessResponse{
+			Message: "Confirm the change with the link sent to the new email",
+			Data:    nil,
+		}
+		jsonResp, err := json.Marshal(successResp)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+
+		fmt.Fprint(w, string(jsonResp))
+		return
+
+	default:
+		MethodNotAllowedResponse(w, req)
+	}
+}
+
+// An email change waiting to be confirmed, shown by the link sent to the
+// new email
+type pendingEmailChange struct {
+	NewEmail string `json:"new_email"`
+	Token    string `json:"token"`
+}
+
+// Returns the user an email change token was issued to, as long as they
+// are still at the version and have the email it was issued for
+func (s *Server) emailChangeUser(ctx context.Context, token string) (User, emailChangeClaims, error) {
+	invalid := newAPIError(http.StatusBadRequest, CodeEmailConfirmationInvalid, "Confirmation link is invalid or has expired")
+	claims, err := s.tokens.checkEmailChangeToken(token)
+	if err != nil {
+		return User{}, claims, invalid
+	}
+
+	user, err := s.getUserByID(ctx, claims.Subject)
+	if errors.Is(err, errUserNotFound) {
+		return User{}, claims, invalid
+	} else if err != nil {
+		return User{}, claims, err
+	}
+	if user.Version != claims.Version || user.Email != claims.Email {
+		return User{}, claims, invalid
+	}
+	return user, claims, nil
+}
+
+// Media type of the form of the page confirming an email change
+const formContentType = "application/x-www-form-urlencoded"
+
+// Page the link confirming an email change opens in a browser. The change
+// is only made by submitting its form
+var emailConfirmPage = template.Must(template.New("email_confirm").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Confirm your new email</title>
+</head>
+<body>
+{{if .Error}}<p>{{.Error}}</p>
+{{else if .Done}}<p>Your email is now {{.NewEmail}}.</p>
+{{else}}<form method="post">
+<p>Change the email of your account to {{.NewEmail}}?</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Confirm</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+// What the page confirming an email change shows
+type emailConfirmPageData struct {
+	pendingEmailChange
+	Done  bool
+	Error string
+}
+
+// Checks if a request comes from a browser, which is given the page rather
+// than json
+func wantsEmailConfirmPage(req *http.Request) bool {
+	if req.Method == http.MethodPost {
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		return mediaType == formContentType
+	}
+	for _, accept := range req.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			if strings.EqualFold(strings.TrimSpace(strings.Split(mediaType, ";")[0]), "text/html") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Writes the page confirming an email change, showing err in place of the
+// form when there is one
+func writeEmailConfirmPage(w http.ResponseWriter, req *http.Request, page emailConfirmPageData, err error) {
+	status := http.StatusOK
+	if err != nil {
+		apiErr, ok := err.(*APIError)
+		if !ok {
+			loggerFrom(req.Context()).Error("Internal error", "error", err)
+			apiErr = newAPIError(http.StatusInternalServerError, CodeInternal, "Something went wrong")
+		}
+		status = apiErr.Status
+		page.Error = localizerFor(req).localize(apiErr).Message
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'")
+	w.WriteHeader(status)
+	emailConfirmPage.Execute(w, page)
+}
+
+// Endpoint the link confirming an email change points to. Opening the link
+// only shows the change with its token, as mail scanners open links on
+// their own: the email changes when the token is sent in a POST. Browsers
+// are shown a page whose form sends it
+func (s *Server) ConfirmEmail(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	page := wantsEmailConfirmPage(req)
+
+	var payload emailConfirmation
+	switch req.Method {
+	case http.MethodGet:
+		payload.Token = req.URL.Query().Get("token")
+	case http.MethodPost:
+		if page {
+			payload.Token = req.PostFormValue("token")
+			break
+		}
+		err := json.NewDecoder(req.Body).Decode(&payload)
+		if err != nil {
+			InvalidJsonResp(w, req, err)
+			return
+		}
+	default:
+		MethodNotAllowedResponse(w, req)
+		return
+	}
+
+	fail := func(err error) {
+		if page {
+			writeEmailConfirmPage(w, req, emailConfirmPageData{}, err)
+			return
+		}
+		writeError(w, req, err)
+	}
+
+	err := validateInput(payload)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	user, claims, err := s.emailChangeUser(req.Context(), payload.Token)
+	if err != nil {
+		fail(err)
+		return
+	}
+	pending := pendingEmailChange{NewEmail: claims.NewEmail, Token: payload.Token}
+
+	var successResp SuccessResponse
+	if req.Method == http.MethodGet {
+		if page {
+			writeEmailConfirmPage(w, req, emailConfirmPageData{pendingEmailChange: pending}, nil)
+			return
+		}
+		successResp = SuccessResponse{
+			Message: "Confirm the change by sending the token in a POST to this link",
+			Data:    pending,
+		}
+	} else {
+		// the unique index decides if the email is still free
+		user.Email = claims.NewEmail
+		err = s.updateUser(req.Context(), user)
+		if errors.Is(err, errUserExists) {
+			fail(newAPIError(http.StatusConflict, CodeEmailInUse, "Email is already in use"))
+			return
+		} else if err != nil {
+			fail(updateConflict(req, err))
+			return
+		}
+		user.Version++
+
+		if page {
+			writeEmailConfirmPage(w, req, emailConfirmPageData{pendingEmailChange: pending, Done: true}, nil)
+			return
+		}
+		user.HashedPassword = ""
+		successResp = SuccessResponse{
+			Message: "success",
+			Data:    user,
+		}
+	}
+	jsonResp, err := json.Marshal(successResp)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Stable, machine readable error codes. Clients should switch on these
+// rather than on the human readable message, which may change.
+const (
+	CodeInvalidPayload      = "INVALID_PAYLOAD"
+	CodeInvalidJSON         = "INVALID_JSON"
+	CodeValidationFailed    = "VALIDATION_FAILED"
+	CodeMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+	CodeNotFound            = "RESOURCE_NOT_FOUND"
+	CodeInternal            = "INTERNAL_ERROR"
+	CodeTokenMissing        = "AUTH_TOKEN_MISSING"
+	CodeTokenMalformed      = "AUTH_TOKEN_MALFORMED"
+	CodeBasicTokenInvalid   = "AUTH_BASIC_TOKEN_INVALID"
+	CodeTokenExpired        = "AUTH_TOKEN_EXPIRED"
+	CodeTokenInvalid        = "AUTH_TOKEN_INVALID"
+	CodeRefreshTokenExpired = "AUTH_REFRESH_TOKEN_EXPIRED"
+	CodeInvalidCredentials  = "AUTH_INVALID_CREDENTIALS"
+	CodeIncorrectLogin      = "AUTH_INCORRECT_LOGIN"
+	CodeIncorrectPassword   = "AUTH_INCORRECT_PASSWORD"
+	CodeUserNotFound        = "USER_NOT_FOUND"
+	CodeUserAlreadyExists   = "USER_ALREADY_EXISTS"
+	CodePasswordPolicy      = "PASSWORD_POLICY_VIOLATION"
+	CodeRateLimited         = "RATE_LIMITED"
+
+	CodePreconditionRequired = "PRECONDITION_REQUIRED"
+	CodePreconditionFailed   = "PRECONDITION_FAILED"
+	CodeUpdateConflict       = "UPDATE_CONFLICT"
+	CodeLocationRequired     = "LOCATION_REQUIRED"
+	CodeNotDiscoverable      = "NOT_DISCOVERABLE"
+
+	CodeEmailUnchanged           = "EMAIL_UNCHANGED"
+	CodeEmailInUse               = "EMAIL_IN_USE"
+	CodeEmailConfirmationInvalid = "EMAIL_CONFIRMATION_INVALID"
+)
+
+const (
+	jsonContentType        = "application/json"
+	problemJSONContentType = "application/problem+json"
+
+	// problem type used when the code alone identifies the problem
+	defaultProblemType = "about:blank"
+)
+
+// APIError is an error that is rendered to the client.
+// Status is the http status code, Code a stable identifier,
+// Message a human readable description and Fields optional per field details
+type APIError struct {
+	Status  int                   `json:"-"`
+	Code    string                `json:"code"`
+	Message string                `json:"error"`
+	Fields  map[string]FieldError `json:"fields,omitempty"`
+
+	// id of the request that failed, for matching reports with logs
+	RequestID string `json:"request_id,omitempty"`
+
+	// parameters of the message catalog entry for Code
+	params []string
+}
+
+// FieldError describes why a single field of a payload was rejected
+type FieldError struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+
+	// message catalog entry and parameters the message was built from
+	key    string
+	params []string
+}
+
+// Creates a field error, building the message from the default locale
+func newFieldError(rule, key string, params ...string) FieldError {
+	message, _ := defaultLocalizer.T(key, params...)
+	return FieldError{Rule: rule, Message: message, key: key, params: params}
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Creates a new api error
+func newAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+// RFC 7807 representation of an api error
+type problemDetails struct {
+	Type   string                `json:"type"`
+	Title  string                `json:"title"`
+	Status int                   `json:"status"`
+	Detail string                `json:"detail"`
+	Code   string                `json:"code"`
+	Fields map[string]FieldError `json:"fields,omitempty"`
+
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Checks if the client asked for RFC 7807 problem details
+func wantsProblemJSON(req *http.Request) bool {
+	if req == nil {
+		return false
+	}
+	for _, accept := range req.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType = strings.TrimSpace(strings.Split(mediaType, ";")[0])
+			if strings.EqualFold(mediaType, problemJSONContentType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Writes an error to the client, every error response goes through here.
+// Errors that are not an *APIError are logged and reported as internal errors.
+// Messages are translated to the language the client accepts
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		if req != nil {
+			loggerFrom(req.Context()).Error("Internal error", "error", err)
+		}
+		apiErr = newAPIError(http.StatusInternalServerError, CodeInternal, "Something went wrong")
+	}
+	l := localizerFor(req)
+	apiErr = l.localize(apiErr)
+	if req != nil {
+		apiErr.RequestID = requestIDFrom(req.Context())
+	}
+
+	var body interface{} = apiErr
+	contentType := jsonContentType
+	if wantsProblemJSON(req) {
+		contentType = problemJSONContentType
+		body = problemDetails{
+			Type:   defaultProblemType,
+			Title:  http.StatusText(apiErr.Status),
+			Status: apiErr.Status,
+			Detail: apiErr.Message,
+			Code:   apiErr.Code,
+			Fields: apiErr.Fields,
+
+			RequestID: apiErr.RequestID,
+		}
+	}
+
+	jsonResp, err := json.Marshal(body)
+	if err != nil {
+		jsonResp = []byte(`{"code":"` + CodeInternal + `","error":"Something went wrong"}`)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Language", l.locale())
+	w.WriteHeader(apiErr.Status)
+	w.Write(jsonResp)
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-playground/validator"
+)
+
+// Radius of the earth in meters, the one MongoDB measures spherical
+// distances with so every storage finds the same users
+const earthRadius = 6378100.0
+
+// Type of a GeoJSON point
+const geoPointType = "Point"
+
+// GeoPoint is a GeoJSON point, its coordinates are the longitude then the
+// latitude in decimal degrees
+type GeoPoint struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+// Returns the point at a longitude and latitude
+func newGeoPoint(longitude, latitude float64) *GeoPoint {
+	return &GeoPoint{Type: geoPointType, Coordinates: []float64{longitude, latitude}}
+}
+
+func (p GeoPoint) longitude() float64 {
+	return p.Coordinates[0]
+}
+
+func (p GeoPoint) latitude() float64 {
+	return p.Coordinates[1]
+}
+
+// Reports a point that is not a GeoJSON point or whose coordinates are out
+// of range
+func validateGeoPoint(sl validator.StructLevel) {
+	p := sl.Current().Interface().(GeoPoint)
+	if p.Type != geoPointType || len(p.Coordinates) != 2 {
+		sl.ReportError(p, "location", "Location", "geojson_point", "")
+		return
+	}
+	// written so NaN is out of range too
+	if !(p.longitude() >= -180 && p.longitude() <= 180) {
+		sl.ReportError(p.Coordinates, "location", "Location", "longitude", "")
+	}
+	if !(p.latitude() >= -90 && p.latitude() <= 90) {
+		sl.ReportError(p.Coordinates, "location", "Location", "latitude", "")
+	}
+}
+
+// Returns the distance in meters between two points along the surface of
+// the earth
+func distance(a, b GeoPoint) float64 {
+	lat1, lat2 := a.latitude()*math.Pi/180, b.latitude()*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.longitude() - a.longitude()) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Returns the latitudes a point within radius meters of center lies between
+func latitudeBand(center GeoPoint, radius float64) (float64, float64) {
+	delta := radius / earthRadius * 180 / math.Pi
+	return center.latitude() - delta, center.latitude() + delta
+}
+
+// Returns the longitudes a point within radius meters of center lies
+// between, west first. West is greater than east when the band crosses the
+// antimeridian. Near the poles any longitude can be within radius
+func longitudeBand(center GeoPoint, radius float64) (west, east float64) {
+	south, north := latitudeBand(center, radius)
+	if south <= -90 || north >= 90 {
+		return -180, 180
+	}
+	spread := math.Sin(radius/earthRadius) / math.Cos(center.latitude()*math.Pi/180)
+	if radius/earthRadius >= math.Pi/2 || spread >= 1 {
+		return -180, 180
+	}
+	delta := math.Asin(spread) * 180 / math.Pi
+
+	west, east = center.longitude()-delta, center.longitude()+delta
+	if west < -180 {
+		west += 360
+	}
+	if east > 180 {
+		east -= 360
+	}
+	return west, east
+}
+
+// Keeps the discoverable users within radius meters of center, nearest
+// first, for the storages that can not sort by distance themselves
+func nearest(center GeoPoint, radius float64, limit int, users []User) []User {
+	found := make([]User, 0, len(users))
+	distances := make(map[string]float64, len(users))
+	for _, user := range users {
+		if !user.Discoverable || user.Location == nil {
+			continue
+		}
+		d := distance(center, *user.Location)
+		if d > radius {
+			continue
+		}
+		distances[user.ID] = d
+		found = append(found, user)
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return distances[found[i].ID] < distances[found[j].ID]
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+// Query of a search for nearby users, the radius is in meters and rounded up
+// to nearbyDistanceStep
+type nearbyQuery struct {
+	Radius float64 `json:"radius" validate:"required,min=1"`
+	Limit  int     `json:"limit" validate:"min=0,max=100"`
+}
+
+// Number of nearby users returned when the query sets no limit
+const defaultNearbyLimit = 20
+
+// Meters the distance to a nearby user is rounded up to, so their location
+// can not be found from distances measured at a few points
+const nearbyDistanceStep = 500.0
+
+// A user found near the logged in user, with only what they share with
+// other users. Their location is never shared
+type nearbyUser struct {
+	ID        string `json:"id"`
+	FirstName string `json:"first_name"`
+
+	// in meters from the logged in user, rounded up to nearbyDistanceStep
+	Distance float64 `json:"distance"`
+}
+
+// Returns a distance rounded up to nearbyDistanceStep, at least one step
+func coarseDistance(d float64) float64 {
+	return math.Max(1, math.Ceil(d/nearbyDistanceStep)) * nearbyDistanceStep
+}
+
+// Reads the query of a search for nearby users
+func parseNearbyQuery(req *http.Request, maxRadius int) (nearbyQuery, error) {
+	query := nearbyQuery{Limit: defaultNearbyLimit}
+	problems := make(map[string]FieldError)
+
+	values := req.URL.Query()
+	if raw := values.Get("radius"); raw != "" {
+		radius, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(radius) {
+			problems["radius"] = newFieldError("number", "field.number", "radius")
+		}
+		query.Radius = radius
+	}
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil {
+			problems["limit"] = newFieldError("number", "field.number", "limit")
+		}
+		query.Limit = limit
+	}
+	if len(problems) == 0 {
+		if err := validateInput(query); err != nil {
+			return query, err
+		}
+		if query.Radius > float64(maxRadius) {
+			problems["radius"] = newFieldError("max", "field.max", "radius", strconv.Itoa(maxRadius))
+		}
+	}
+
+	if len(problems) > 0 {
+		apiErr := newAPIError(http.StatusBadRequest, CodeValidationFailed, "Invalid Payload")
+		apiErr.Fields = problems
+		if len(problems) == 1 {
+			for _, problem := range problems {
+				apiErr.Message = problem.Message
+			}
+		}
+		return query, apiErr
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultNearbyLimit
+	}
+	// radii within one step find the same users, so distances can not be
+	// narrowed down below the step by searching at several radii
+	query.Radius = math.Min(coarseDistance(query.Radius), float64(maxRadius))
+	return query, nil
+}
+
+// Endpoint finding the discoverable users near the logged in user, who has
+// to be discoverable too. It is only served when enabled in the configuration
+func (s *Server) NearbyUsers(w http.ResponseWriter, req *http.Request) {
+	const userKey Key = "user"
+	user, ok := req.Context().Value(userKey).(User)
+	if !ok {
+		InternalIssues(w, req)
+		return
+	}
+
+	if !s.cfg.NearbyUsers {
+		s.NotAvailable(w, req)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		query, err := parseNearbyQuery(req, s.cfg.NearbyMaxRadius)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		if !user.Discoverable {
+			writeError(w, req, newAPIError(http.StatusBadRequest, CodeNotDiscoverable, "Make yourself discoverable to find users near you"))
+			return
+		}
+		if user.Location == nil {
+			writeError(w, req, newAPIError(http.StatusBadRequest, CodeLocationRequired, "Set your location to find users near you"))
+			return
+		}
+
+		users, err := s.nearbyUsers(req.Context(), *user.Location, query.Radius, query.Limit, user.ID)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		found := make([]nearbyUser, 0, len(users))
+		for _, other := range users {
+			found = append(found, nearbyUser{
+				ID:        other.ID,
+				FirstName: other.FirstName,
+				Distance:  coarseDistance(distance(*user.Location, *other.Location)),
+			})
+		}
+
+		successResp := SuccessResponse{
+			Message: "success",
+			Data:    found,
+		}
+		jsonResp, err := json.Marshal(successResp)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+
+		fmt.Fprint(w, string(jsonResp))
+		return
+
+	default:
+		MethodNotAllowedResponse(w, req)
+	}
+}
@@ -1,16 +1,11 @@
 package server
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type loginInfo struct {
@@ -18,15 +13,19 @@ type loginInfo struct {
 	Password string `json:"password" validate:"required"`
 }
 
+type passwordChange struct {
+	CurrentPassword    string `json:"current_password" validate:"required"`
+	NewPassword        string `json:"new_password" validate:"required"`
+	ConfirmNewPassword string `json:"confirm_new_password" validate:"eqfield=NewPassword"`
+}
+
 // Endpoint for formatting invalid url requests
-func NotAvailable(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusNotFound)
-	fmt.Fprint(w, `{"error" : "Resource not found"}`)
+func (s *Server) NotAvailable(w http.ResponseWriter, req *http.Request) {
+	writeError(w, req, newAPIError(http.StatusNotFound, CodeNotFound, "Resource not found"))
 }
 
 // Endpoint for registering a user
-func Register(w http.ResponseWriter, req *http.Request) {
+func (s *Server) Register(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodPost:
 
@@ -37,48 +36,56 @@ func Register(w http.ResponseWriter, req *http.Request) {
 
 		err = json.NewDecoder(req.Body).Decode(&userPayload)
 		if err != nil {
-			InvalidJsonResp(w, err)
+			InvalidJsonResp(w, req, err)
 			return
 		}
+		userPayload.Email = s.emails.Normalize(userPayload.Email)
 
-		err, aboveOneField := validateInput(userPayload)
-		if aboveOneField {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, `{"error" : "Invalid Payload"}`)
+		err = validateInput(userPayload)
+		if err != nil {
+			writeError(w, req, err)
 			return
 		}
+
+		err = s.passwordPolicy.Check("password", userPayload.Password, userPayload.Email, userPayload.FirstName)
 		if err != nil {
-			InvalidJsonResp(w, err)
+			writeError(w, req, err)
 			return
 		}
 
 		user := User{
+			ID:         newUserID(),
 			Email:      userPayload.Email,
 			DateJoined: time.Now(),
 			LastLogin:  time.Now(),
 			IsActive:   true,
 			FirstName:  userPayload.FirstName,
+			Version:    1,
 		}
-		user.HashedPassword, err = HashPassword(userPayload.Password)
+		user.HashedPassword, err = s.hashPassword(req.Context(), userPayload.Password)
 		if err != nil {
-			InternalIssues(w)
+			writeError(w, req, err)
 			return
 		}
 
-		err = addUser(Client, user)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, `{"error" : "User already exists, please login"}`)
+		err = s.addUser(req.Context(), user)
+		if errors.Is(err, errUserExists) {
+			writeError(w, req, newAPIError(http.StatusConflict, CodeUserAlreadyExists, "User already exists, please login"))
+			return
+		} else if err != nil {
+			writeError(w, req, err)
 			return
 		}
+		s.metrics.registrations.Inc()
 
-		accessToken, refreshToken, err := GenerateToken(user.Email)
+		accessToken, refreshToken, err := s.generateToken(req.Context(), user.ID)
 		if err != nil {
-			InternalIssues(w)
+			writeError(w, req, err)
 			return
 		}
 
 		logRes := loginResponse{
+			ID:           user.ID,
 			Email:        user.Email,
 			FirstName:    user.FirstName,
 			IsActive:     user.IsActive,
@@ -93,20 +100,21 @@ func Register(w http.ResponseWriter, req *http.Request) {
 		}
 		jsonResp, err := json.Marshal(successResp)
 		if err != nil {
-			InternalIssues(w)
+			writeError(w, req, err)
+			return
 		}
 
 		fmt.Fprint(w, string(jsonResp))
 		return
 
 	default:
-		MethodNotAllowedResponse(w)
+		MethodNotAllowedResponse(w, req)
 		return
 	}
 }
 
 // Endpoint for logging in a User
-func Login(w http.ResponseWriter, req *http.Request) {
+func (s *Server) Login(w http.ResponseWriter, req *http.Request) {
 
 	switch req.Method {
 	case http.MethodPost:
@@ -115,47 +123,52 @@ func Login(w http.ResponseWriter, req *http.Request) {
 
 		err := json.NewDecoder(req.Body).Decode(&loginDetails)
 		if err != nil {
-			InvalidJsonResp(w, err)
-			return
-		}
-		err, aboveOneField := validateInput(loginDetails)
-		if aboveOneField {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, `{"error" : "Invalid Payload"}`)
+			InvalidJsonResp(w, req, err)
 			return
 		}
+		loginDetails.Email = s.emails.Normalize(loginDetails.Email)
+		err = validateInput(loginDetails)
 		if err != nil {
-			InvalidJsonResp(w, err)
+			s.metrics.logins.WithLabelValues("invalid_payload").Inc()
+			writeError(w, req, err)
 			return
 		}
 
-		user, err := getUser(Client, loginDetails.Email)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, `{"error" : "User does not exist"}`)
+		user, err := s.getUser(req.Context(), loginDetails.Email)
+		if errors.Is(err, errUserNotFound) {
+			s.metrics.logins.WithLabelValues("user_not_found").Inc()
+			writeError(w, req, newAPIError(http.StatusBadRequest, CodeUserNotFound, "User does not exist"))
+			return
+		} else if err != nil {
+			s.metrics.logins.WithLabelValues("error").Inc()
+			writeError(w, req, err)
 			return
 		}
 
-		err = CheckPasswordHash(loginDetails.Password, user.HashedPassword)
+		err = s.checkPassword(req.Context(), loginDetails.Password, user.HashedPassword)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, `{"error" : "Email/Password is incorrect"}`)
+			s.metrics.logins.WithLabelValues("wrong_password").Inc()
+			writeError(w, req, newAPIError(http.StatusBadRequest, CodeIncorrectLogin, "Email/Password is incorrect"))
 			return
 		}
 
-		accessToken, refreshToken, err := GenerateToken(user.Email)
+		accessToken, refreshToken, err := s.generateToken(req.Context(), user.ID)
 		if err != nil {
-			InternalIssues(w)
+			s.metrics.logins.WithLabelValues("error").Inc()
+			writeError(w, req, err)
 			return
 		}
+		s.metrics.logins.WithLabelValues("success").Inc()
 
 		logRes := loginResponse{
+			ID:           user.ID,
 			Email:        user.Email,
 			FirstName:    user.FirstName,
 			IsActive:     user.IsActive,
 			DateJoined:   user.DateJoined,
 			LastLogin:    user.LastLogin,
 			UserAddress:  user.UserAddress,
+			Address:      user.Address,
 			PhoneNumber:  user.PhoneNumber,
 			AccessToken:  accessToken,
 			RefreshToken: refreshToken,
@@ -166,7 +179,7 @@ func Login(w http.ResponseWriter, req *http.Request) {
 		}
 		jsonResp, err := json.Marshal(successResp)
 		if err != nil {
-			InternalIssues(w)
+			writeError(w, req, err)
 			return
 		}
 
@@ -174,21 +187,22 @@ func Login(w http.ResponseWriter, req *http.Request) {
 		return
 
 	default:
-		MethodNotAllowedResponse(w)
+		MethodNotAllowedResponse(w, req)
 	}
 }
 
 // Endpoint to Retrieve, Update and Delete User Profile
-func UserProfile(w http.ResponseWriter, req *http.Request) {
+func (s *Server) UserProfile(w http.ResponseWriter, req *http.Request) {
 	const userKey Key = "user"
 	user, ok := req.Context().Value(userKey).(User)
 	if !ok {
-		InternalIssues(w)
+		InternalIssues(w, req)
 		return
 	}
 
 	switch req.Method {
 	case http.MethodGet:
+		w.Header().Set("ETag", userETag(user))
 		user.HashedPassword = ""
 		successResp := SuccessResponse{
 			Message: "success",
@@ -196,7 +210,7 @@ func UserProfile(w http.ResponseWriter, req *http.Request) {
 		}
 		jsonResp, err := json.Marshal(successResp)
 		if err != nil {
-			InternalIssues(w)
+			writeError(w, req, err)
 			return
 		}
 
@@ -204,45 +218,63 @@ func UserProfile(w http.ResponseWriter, req *http.Request) {
 		return
 
 	case http.MethodPatch:
+		s.patchProfile(w, req, user)
+		return
+
+	case http.MethodPut:
 
+		err := s.checkIfMatch(req, user)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+
+		var body json.RawMessage
 		var incomingPayload User
-		err := json.NewDecoder(req.Body).Decode(&incomingPayload)
+		err = json.NewDecoder(req.Body).Decode(&body)
+		if err == nil {
+			err = json.Unmarshal(body, &incomingPayload)
+		}
 		if err != nil {
-			InvalidJsonResp(w, err)
+			InvalidJsonResp(w, req, err)
 			return
 		}
+		var sent map[string]json.RawMessage
+		json.Unmarshal(body, &sent)
 
+		incomingPayload.ID = user.ID
 		incomingPayload.Email = user.Email
 		incomingPayload.HashedPassword = user.HashedPassword
 		incomingPayload.IsActive = true
 		incomingPayload.DateJoined = user.DateJoined
 		incomingPayload.LastLogin = user.LastLogin
+		incomingPayload.Version = user.Version
 
-		if incomingPayload.DeviceID == "" {
-			incomingPayload.DeviceID = user.DeviceID
+		current := newProfileUpdate(user)
+		profile := newProfileUpdate(incomingPayload)
+		if _, ok := sent["address"]; !ok {
+			profile.keepLegacyAddress(current)
 		}
-
-		if incomingPayload.FirstName == "" {
-			incomingPayload.FirstName = user.FirstName
-		}
-		if incomingPayload.Latitude == "" {
-			incomingPayload.Latitude = user.Latitude
-		}
-		if incomingPayload.Longitude == "" {
-			incomingPayload.Longitude = user.Longitude
-		}
-		if incomingPayload.PhoneNumber == "" {
-			incomingPayload.PhoneNumber = user.PhoneNumber
+		err = profile.normalize(current, s.cfg.PhoneDefaultRegion)
+		if err != nil {
+			writeError(w, req, err)
+			return
 		}
-		if incomingPayload.UserAddress == "" {
-			incomingPayload.UserAddress = user.UserAddress
+		profile.applyTo(&incomingPayload)
+
+		err = validateInput(incomingPayload)
+		if err != nil {
+			writeError(w, req, err)
+			return
 		}
 
-		err = updateUser(Client, incomingPayload)
+		err = s.updateUser(req.Context(), incomingPayload)
 		if err != nil {
-			InternalIssues(w)
+			writeError(w, req, updateConflict(req, err))
 			return
 		}
+		incomingPayload.Version++
+		w.Header().Set("ETag", userETag(incomingPayload))
 		incomingPayload.HashedPassword = ""
 		successResp := SuccessResponse{
 			Message: "success",
@@ -250,41 +282,74 @@ func UserProfile(w http.ResponseWriter, req *http.Request) {
 		}
 		jsonResp, err := json.Marshal(successResp)
 		if err != nil {
-			InternalIssues(w)
+			writeError(w, req, err)
 			return
 		}
 
 		fmt.Fprint(w, string(jsonResp))
 		return
 
-	case http.MethodPut:
+	default:
+		MethodNotAllowedResponse(w, req)
+	}
+}
 
-		var incomingPayload User
-		err := json.NewDecoder(req.Body).Decode(&incomingPayload)
+// Endpoint to change the password of the logged in user
+func (s *Server) ChangePassword(w http.ResponseWriter, req *http.Request) {
+	const userKey Key = "user"
+	user, ok := req.Context().Value(userKey).(User)
+	if !ok {
+		InternalIssues(w, req)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+
+		var payload passwordChange
+		err := json.NewDecoder(req.Body).Decode(&payload)
 		if err != nil {
-			InvalidJsonResp(w, err)
+			InvalidJsonResp(w, req, err)
 			return
 		}
 
-		incomingPayload.Email = user.Email
-		incomingPayload.HashedPassword = user.HashedPassword
-		incomingPayload.IsActive = true
-		incomingPayload.DateJoined = user.DateJoined
-		incomingPayload.LastLogin = user.LastLogin
+		err = validateInput(payload)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
 
-		err = updateUser(Client, incomingPayload)
+		err = s.checkPassword(req.Context(), payload.CurrentPassword, user.HashedPassword)
 		if err != nil {
-			InternalIssues(w)
+			writeError(w, req, newAPIError(http.StatusBadRequest, CodeIncorrectPassword, "Current password is incorrect"))
 			return
 		}
-		incomingPayload.HashedPassword = ""
+
+		err = s.passwordPolicy.Check("new_password", payload.NewPassword, user.Email, user.FirstName)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+
+		user.HashedPassword, err = s.hashPassword(req.Context(), payload.NewPassword)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+
+		err = s.updateUser(req.Context(), user)
+		if err != nil {
+			writeError(w, req, updateConflict(req, err))
+			return
+		}
+
 		successResp := SuccessResponse{
 			Message: "success",
-			Data:    incomingPayload,
+			Data:    nil,
 		}
 		jsonResp, err := json.Marshal(successResp)
 		if err != nil {
-			InternalIssues(w)
+			writeError(w, req, err)
 			return
 		}
 
@@ -292,16 +357,16 @@ func UserProfile(w http.ResponseWriter, req *http.Request) {
 		return
 
 	default:
-		MethodNotAllowedResponse(w)
+		MethodNotAllowedResponse(w, req)
 	}
 }
 
 // Endpoint to refresh expired access token
-func RefreshTokenAPI(w http.ResponseWriter, req *http.Request) {
+func (s *Server) RefreshTokenAPI(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// Set CORS Headers since no middleware attached
-	w.Header().Set("Access-Control-Allow-Origin", frontEndOrigin)
+	w.Header().Set("Access-Control-Allow-Origin", s.cfg.CORSOrigin)
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
 	switch req.Method {
@@ -309,30 +374,36 @@ func RefreshTokenAPI(w http.ResponseWriter, req *http.Request) {
 		var refreshToken tokenDetails
 		err := json.NewDecoder(req.Body).Decode(&refreshToken)
 		if err != nil {
-			InvalidJsonResp(w, err)
+			InvalidJsonResp(w, req, err)
 			return
 		}
-		err, _ = validateInput(refreshToken)
+		err = validateInput(refreshToken)
 		if err != nil {
-			InvalidJsonResp(w, err)
+			writeError(w, req, err)
 			return
 		}
 
-		email, err := checkRefreshToken(refreshToken.RefreshToken)
+		userID, err := s.checkRefreshToken(req.Context(), refreshToken.RefreshToken)
+		if err != nil {
+			s.metrics.tokenRejected("refresh", err)
+		}
 		if err != nil && "Token is expired" == err.Error() {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, `{"error" : "Token has expired, please login"}`)
+			s.metrics.tokenRefreshes.WithLabelValues("expired").Inc()
+			writeError(w, req, newAPIError(http.StatusBadRequest, CodeRefreshTokenExpired, "Token has expired, please login"))
 			return
 		} else if err != nil {
-			unauthorizedResponse(w)
+			s.metrics.tokenRefreshes.WithLabelValues("invalid").Inc()
+			unauthorizedResponse(w, req)
 			return
 		}
 
-		accessToken, err := newAccessToken(fmt.Sprint(email))
+		accessToken, err := s.newAccessToken(req.Context(), userID)
 		if err != nil {
-			InternalIssues(w)
+			s.metrics.tokenRefreshes.WithLabelValues("error").Inc()
+			writeError(w, req, err)
 			return
 		}
+		s.metrics.tokenRefreshes.WithLabelValues("success").Inc()
 
 		data := tokenDetails{AccessToken: accessToken}
 		resp := SuccessResponse{
@@ -342,76 +413,14 @@ func RefreshTokenAPI(w http.ResponseWriter, req *http.Request) {
 
 		jsonResp, err := json.Marshal(resp)
 		if err != nil {
-			InternalIssues(w)
+			writeError(w, req, err)
 			return
 		}
 		fmt.Fprint(w, string(jsonResp))
 		return
 
 	default:
-		MethodNotAllowedResponse(w)
+		MethodNotAllowedResponse(w, req)
 		return
 	}
 }
-
-// Add User to MongoDB
-func addUser(client *mongo.Client, userDetails User) error {
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	collection := client.Database("account").Collection("user")
-
-	// check if user exists
-	var duplicateUser User
-	filter := bson.M{"email": userDetails.Email}
-	err := collection.FindOne(ctx, filter).Decode(&duplicateUser)
-	if err != nil {
-		// User does not exist
-		_, err = collection.InsertOne(ctx, userDetails)
-		if err != nil {
-			log.Println("Error in inserting item with error, ", err)
-			return err
-		}
-		return nil
-	}
-
-	if duplicateUser.Email == userDetails.Email {
-		return errors.New("User already exists")
-	}
-	return nil
-}
-
-// Retrieve User from MongoDB
-func getUser(client *mongo.Client, email string) (User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	collection := client.Database("account").Collection("user")
-
-	// check if user exists
-	var userDetails User
-	filter := bson.M{"email": email}
-	err := collection.FindOne(ctx, filter).Decode(&userDetails)
-
-	if err != nil {
-		return User{}, err
-	}
-	return userDetails, nil
-}
-
-// update details of a user
-func updateUser(client *mongo.Client, user User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	collection := client.Database("account").Collection("user")
-	filter := bson.M{"email": user.Email}
-	update := bson.M{"$set": user}
-	_, err := collection.UpdateOne(ctx, filter, update)
-	if err != nil {
-		log.Println("Error in updating User, ", err)
-		return err
-	}
-	return nil
-}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Paths probed by the orchestrator, served without authentication
+const (
+	livenessPath  = "/healthz"
+	readinessPath = "/readyz"
+)
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+// Result of a single readiness check
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// Writes a health response, failing ones as 503
+func writeHealth(w http.ResponseWriter, resp healthResponse) {
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	if resp.Status != statusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Endpoint reporting that the process is alive
+func (s *Server) Liveness(w http.ResponseWriter, req *http.Request) {
+	writeHealth(w, healthResponse{Status: statusOK})
+}
+
+// Endpoint reporting whether the server can serve traffic, with the
+// status of each dependency
+func (s *Server) Readiness(w http.ResponseWriter, req *http.Request) {
+	checks := map[string]checkResult{
+		"storage":      {Status: statusOK},
+		"signing_keys": {Status: statusOK},
+		"draining":     {Status: statusOK},
+	}
+
+	if s.db == nil {
+		checks["storage"] = checkResult{Status: statusFail, Error: "storage is not configured"}
+	} else if err := s.db.Ping(req.Context()); err != nil {
+		// the error can name hosts and credentials, it is only logged
+		loggerFrom(req.Context()).Error("Storage is not ready", "error", err)
+		checks["storage"] = checkResult{Status: statusFail}
+	}
+
+	if len(s.tokens.signingKey) == 0 || len(s.tokens.refreshSigningKey) == 0 {
+		checks["signing_keys"] = checkResult{Status: statusFail, Error: "signing keys are not loaded"}
+	}
+
+	if s.Draining() {
+		checks["draining"] = checkResult{Status: statusFail, Error: "server is shutting down"}
+	}
+
+	resp := healthResponse{Status: statusOK, Checks: checks}
+	for _, check := range checks {
+		if check.Status != statusOK {
+			resp.Status = statusFail
+		}
+	}
+	writeHealth(w, resp)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/locales"
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/fr"
+	ut "github.com/go-playground/universal-translator"
+)
+
+// Locale every message falls back to
+const defaultLocale = "en"
+
+var (
+	universalTranslator = newUniversalTranslator(en.New(), fr.New())
+
+	// Translator for the default locale, used to build messages before
+	// the locale of the client is known
+	defaultLocalizer = localizer{universalTranslator.GetFallback()}
+)
+
+// Builds the translator for the supported locales from the message catalogs,
+// the first locale is the fallback
+func newUniversalTranslator(fallback locales.Translator, supported ...locales.Translator) *ut.UniversalTranslator {
+	uni := ut.New(fallback, append([]locales.Translator{fallback}, supported...)...)
+
+	for locale, catalog := range messageCatalogs {
+		trans, found := uni.GetTranslator(locale)
+		if !found {
+			log.Fatalf("No translator for message catalog %s", locale)
+		}
+		for key, text := range catalog {
+			if err := trans.Add(key, text, false); err != nil {
+				log.Fatalf("Invalid %s message %s, %s", locale, key, err)
+			}
+		}
+	}
+	return uni
+}
+
+// A localizer holds the translators to try, in order of preference
+type localizer []ut.Translator
+
+// Returns the localizer for the languages a client accepts. Each language
+// falls back to its base language and finally to the default locale
+func localizerFor(req *http.Request) localizer {
+	var l localizer
+	seen := make(map[string]bool)
+	add := func(locale string) {
+		trans, found := universalTranslator.GetTranslator(locale)
+		if found && !seen[trans.Locale()] {
+			seen[trans.Locale()] = true
+			l = append(l, trans)
+		}
+	}
+
+	if req != nil {
+		for _, tag := range parseAcceptLanguage(req.Header.Get("Accept-Language")) {
+			locale := strings.Replace(tag, "-", "_", -1)
+			add(locale)
+			add(strings.Split(locale, "_")[0])
+		}
+	}
+	add(defaultLocale)
+	return l
+}
+
+// Locale of the preferred translator
+func (l localizer) locale() string {
+	return strings.Replace(l[0].Locale(), "_", "-", -1)
+}
+
+// Translates a message, reporting false if no translator knows the key
+func (l localizer) T(key string, params ...string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	for _, trans := range l {
+		if message, err := trans.T(key, params...); err == nil {
+			return message, true
+		}
+	}
+	return "", false
+}
+
+// Returns a copy of the error with its messages translated. Messages
+// without a translation, or raised for this error only, are left as they are
+func (l localizer) localize(e *APIError) *APIError {
+	localized := *e
+	if len(e.Fields) > 0 {
+		localized.Fields = make(map[string]FieldError, len(e.Fields))
+	}
+	for name, field := range e.Fields {
+		if message, ok := l.T(field.key, field.params...); ok {
+			if field.Message == e.Message {
+				localized.Message = message
+			}
+			field.Message = message
+		}
+		localized.Fields[name] = field
+	}
+
+	if localized.Message == e.Message {
+		standard, ok := defaultLocalizer.T(e.Code, e.params...)
+		if !ok || standard == e.Message {
+			if message, ok := l.T(e.Code, e.params...); ok {
+				localized.Message = message
+			}
+		}
+	}
+	return &localized
+}
+
+// Returns the language tags of an Accept-Language header, most preferred first
+func parseAcceptLanguage(header string) []string {
+	type weightedTag struct {
+		tag    string
+		weight float64
+	}
+
+	var tags []weightedTag
+	for _, part := range strings.Split(header, ",") {
+		pieces := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(pieces[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		weight := 1.0
+		for _, param := range pieces[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err == nil {
+					weight = q
+				}
+			}
+		}
+		if weight > 0 {
+			tags = append(tags, weightedTag{tag, weight})
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].weight > tags[j].weight
+	})
+
+	ordered := make([]string, len(tags))
+	for i, t := range tags {
+		ordered[i] = t.tag
+	}
+	return ordered
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Calls made by the handlers to bcrypt, the token issuer and storage,
+// traced and timed for the metrics
+
+// Hashes a password, timing bcrypt
+func (s *Server) hashPassword(ctx context.Context, password string) (hash string, err error) {
+	_, span := s.tracer.Start(ctx, "bcrypt.hash", trace.WithAttributes(attribute.Int("bcrypt.cost", s.cfg.BcryptCost)))
+	defer func(start time.Time) {
+		s.metrics.passwordHashDuration.WithLabelValues("hash").Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+	}(time.Now())
+	return HashPassword(password, s.cfg.BcryptCost)
+}
+
+// Compares a password with its hash, timing bcrypt. A mismatch is not
+// reported as a failed span
+func (s *Server) checkPassword(ctx context.Context, password, hash string) error {
+	_, span := s.tracer.Start(ctx, "bcrypt.compare")
+	defer func(start time.Time) {
+		s.metrics.passwordHashDuration.WithLabelValues("compare").Observe(time.Since(start).Seconds())
+		span.End()
+	}(time.Now())
+
+	err := CheckPasswordHash(password, hash)
+	span.SetAttributes(attribute.Bool("bcrypt.match", err == nil))
+	return err
+}
+
+func (s *Server) generateToken(ctx context.Context, userID string) (accessToken, refreshToken string, err error) {
+	_, span := s.tracer.Start(ctx, "jwt.sign", trace.WithAttributes(tokenAttribute("access+refresh")))
+	defer func() { endSpan(span, err) }()
+	return s.tokens.GenerateToken(userID)
+}
+
+func (s *Server) newAccessToken(ctx context.Context, userID string) (accessToken string, err error) {
+	_, span := s.tracer.Start(ctx, "jwt.sign", trace.WithAttributes(tokenAttribute("access")))
+	defer func() { endSpan(span, err) }()
+	return s.tokens.newAccessToken(userID)
+}
+
+func (s *Server) checkAccessToken(ctx context.Context, accessToken string) (userID string, err error) {
+	_, span := s.tracer.Start(ctx, "jwt.parse", trace.WithAttributes(tokenAttribute("access")))
+	defer func() { endSpan(span, err) }()
+	return s.tokens.checkAccessToken(accessToken)
+}
+
+func (s *Server) checkRefreshToken(ctx context.Context, refreshToken string) (userID string, err error) {
+	_, span := s.tracer.Start(ctx, "jwt.parse", trace.WithAttributes(tokenAttribute("refresh")))
+	defer func() { endSpan(span, err) }()
+	return s.tokens.checkRefreshToken(refreshToken)
+}
+
+func (s *Server) addUser(ctx context.Context, user User) (err error) {
+	ctx, end := s.storageOperation(ctx, "addUser")
+	defer func() { end(err) }()
+	return s.db.addUser(ctx, user)
+}
+
+func (s *Server) getUser(ctx context.Context, email string) (user User, err error) {
+	ctx, end := s.storageOperation(ctx, "getUser")
+	defer func() { end(err) }()
+	return s.db.getUser(ctx, email)
+}
+
+func (s *Server) getUserByID(ctx context.Context, id string) (user User, err error) {
+	ctx, end := s.storageOperation(ctx, "getUserByID")
+	defer func() { end(err) }()
+	return s.db.getUserByID(ctx, id)
+}
+
+func (s *Server) updateUser(ctx context.Context, user User) (err error) {
+	ctx, end := s.storageOperation(ctx, "updateUser")
+	defer func() { end(err) }()
+	return s.db.updateUser(ctx, user)
+}
+
+func (s *Server) patchUser(ctx context.Context, id string, version int64, patch userPatch) (err error) {
+	ctx, end := s.storageOperation(ctx, "patchUser")
+	defer func() { end(err) }()
+	return s.db.patchUser(ctx, id, version, patch)
+}
+
+func (s *Server) nearbyUsers(ctx context.Context, center GeoPoint, radius float64, limit int, exclude string) (users []User, err error) {
+	ctx, end := s.storageOperation(ctx, "nearbyUsers")
+	defer func() { end(err) }()
+	return s.db.nearbyUsers(ctx, center, radius, limit, exclude)
+}
+
+// Starts a storage operation, returning the function that ends it with the
+// error it returned. A document that is not found or a user that already
+// exists is not a failure
+func (s *Server) storageOperation(ctx context.Context, operation string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := s.tracer.Start(ctx, "storage."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(storageSystem(s.db), semconv.DBOperation(operation)),
+	)
+
+	return ctx, func(err error) {
+		result := resultLabel(err)
+		switch {
+		case errors.Is(err, errUserNotFound):
+			result = "not_found"
+			err = nil
+		case errors.Is(err, errUserExists), errors.Is(err, errVersionConflict):
+			result = "conflict"
+			err = nil
+		}
+		s.metrics.storageDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+		span.SetAttributes(attribute.String("storage.result", result))
+		endSpan(span, err)
+	}
+}
+
+// Names the storage backend in spans
+func storageSystem(db Storage) attribute.KeyValue {
+	switch db.(type) {
+	case *Database:
+		return semconv.DBSystemMongoDB
+	case *Postgres:
+		return semconv.DBSystemPostgreSQL
+	case *SQLite:
+		return semconv.DBSystemSqlite
+	}
+	return semconv.DBSystemKey.String(storageMemory)
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Header carrying the id of a request, accepted from clients and echoed back
+const requestIDHeader = "X-Request-ID"
+
+// Longest request id accepted from a client
+const maxRequestIDLength = 128
+
+// Value logged in place of secrets
+const redacted = "[REDACTED]"
+
+const (
+	requestIDKey Key = "request_id"
+	loggerKey    Key = "logger"
+)
+
+// Parts of attribute names whose values are never logged
+var sensitiveKeys = []string{"password", "hash", "token", "secret", "signingkey", "authorization", "cookie"}
+
+// Patterns of secrets and personal data in free text, like error messages.
+// A pair is redacted when its key looks sensitive
+var (
+	sensitivePair     = regexp.MustCompile(`("?([A-Za-z0-9_-]+)"?\s*[:=]\s*)("[^"]*"|[^\s,;&}]+)`)
+	credentialsInText = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`)
+	passwordInURL     = regexp.MustCompile(`(://[^:/@\s]+:)[^@\s]+@`)
+	jwtInText         = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	emailInText       = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+)
+
+// NewLogger returns a JSON logger writing to w at the given level, one of
+// debug, info, warn or error. Passwords, hashes, tokens and other secrets
+// are redacted from every record, however deeply they are nested
+func NewLogger(w io.Writer, level string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       lvl,
+		ReplaceAttr: redactAttr,
+	}))
+}
+
+// Checks if an attribute name looks like it holds a secret
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(key))
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces the value of secret attributes. Structs, maps and slices are
+// logged as their json form with secret fields removed
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if isSensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	if a.Value.Kind() != slog.KindAny {
+		return a
+	}
+
+	value := a.Value.Any()
+	if err, ok := value.(error); ok {
+		return slog.String(a.Key, redactText(err.Error()))
+	}
+	switch reflect.Indirect(reflect.ValueOf(value)).Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+	default:
+		return a
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return slog.String(a.Key, redacted)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return slog.String(a.Key, redacted)
+	}
+	return slog.Any(a.Key, redactJSON(decoded))
+}
+
+// Redacts the secrets, emails and values of sensitive keys found in free
+// text, which errors wrapping a payload or a driver message can hold
+func redactText(text string) string {
+	text = passwordInURL.ReplaceAllString(text, "${1}"+redacted+"@")
+	text = credentialsInText.ReplaceAllString(text, "$1 "+redacted)
+	text = jwtInText.ReplaceAllString(text, redacted)
+	text = sensitivePair.ReplaceAllStringFunc(text, func(pair string) string {
+		match := sensitivePair.FindStringSubmatch(pair)
+		if !isSensitiveKey(match[2]) {
+			return pair
+		}
+		return match[1] + redacted
+	})
+	return emailInText.ReplaceAllString(text, redacted)
+}
+
+// Redacts the secret fields of a decoded json value
+func redactJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if isSensitiveKey(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactJSON(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactJSON(item)
+		}
+	}
+	return value
+}
+
+// Returns the id of the request ctx belongs to
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Returns the logger of the request ctx belongs to, tagged with its id
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Generates a random request id
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// Checks that a request id sent by a client is safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the address of the client of a request, without the port. When
+// the server is configured to trust the proxies in front of it, the address
+// is the X-Forwarded-For entry the outermost of them added. Proxies append
+// to the header, the entries left of it are sent by the client
+func (s *Server) clientIP(r *http.Request) string {
+	if s.cfg.TrustProxyHeaders {
+		var forwarded []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, strings.Split(header, ",")...)
+		}
+		if i := len(forwarded) - s.cfg.TrustedProxyHops; i >= 0 && i < len(forwarded) {
+			if ip := strings.TrimSpace(forwarded[i]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Middleware that gives every request an id and writes an access log.
+// The id is taken from the X-Request-ID header when the client sent a valid
+// one, echoed in the response and attached to every log of the request
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := s.logger.With("request_id", id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = context.WithValue(ctx, loggerKey, logger)
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if recorder.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logger.LogAttrs(ctx, level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Int("bytes", recorder.bytes),
+			slog.Float64("latency_ms", float64(time.Since(start))/float64(time.Millisecond)),
+			slog.String("client_ip", s.clientIP(r)),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
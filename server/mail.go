@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// Message is an email sent to a user
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Returns the mailer described by the config. Without an SMTP server mails
+// are logged, which is only meant for development
+func newMailer(cfg Config, logger *slog.Logger) Mailer {
+	if cfg.SMTPAddress == "" {
+		return logMailer{logger: logger}
+	}
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(cfg.SMTPAddress)
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	return smtpMailer{address: cfg.SMTPAddress, from: cfg.MailFrom, auth: auth}
+}
+
+// smtpMailer sends mails through an SMTP server
+type smtpMailer struct {
+	address string
+	from    string
+	auth    smtp.Auth
+}
+
+func (m smtpMailer) Send(ctx context.Context, msg Message) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return smtp.SendMail(m.address, m.auth, m.from, []string{msg.To}, []byte(b.String()))
+}
+
+// logMailer logs mails instead of sending them. The body is left out, it
+// can hold links that act for the user
+type logMailer struct {
+	logger *slog.Logger
+}
+
+func (m logMailer) Send(ctx context.Context, msg Message) error {
+	m.logger.Info("Mail not sent, no SMTP server is configured",
+		"to", msg.To, "subject", msg.Subject)
+	return nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStorage keeps the users in memory. It is meant for development and
+// tests, everything is lost on exit
+type MemoryStorage struct {
+	mu sync.RWMutex
+
+	// users keyed by id
+	users map[string]User
+}
+
+// NewMemoryStorage returns an empty in memory storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{users: make(map[string]User)}
+}
+
+// Returns the id of the user with email, ignoring case
+func (m *MemoryStorage) findEmail(email string) (string, bool) {
+	email = strings.ToLower(email)
+	for id, user := range m.users {
+		if strings.ToLower(user.Email) == email {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func (m *MemoryStorage) addUser(ctx context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[user.ID]; ok {
+		return errUserExists
+	}
+	if _, ok := m.findEmail(user.Email); ok {
+		return errUserExists
+	}
+	m.users[user.ID] = user
+	return nil
+}
+
+func (m *MemoryStorage) getUser(ctx context.Context, email string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, ok := m.findEmail(email)
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	return m.users[id], nil
+}
+
+func (m *MemoryStorage) getUserByID(ctx context.Context, id string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	return user, nil
+}
+
+func (m *MemoryStorage) updateUser(ctx context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.users[user.ID]
+	if !ok {
+		return errUserNotFound
+	} else if stored.Version != user.Version {
+		return errVersionConflict
+	}
+	if id, ok := m.findEmail(user.Email); ok && id != user.ID {
+		return errUserExists
+	}
+	user.Version++
+	m.users[user.ID] = user
+	return nil
+}
+
+func (m *MemoryStorage) patchUser(ctx context.Context, id string, version int64, patch userPatch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return errUserNotFound
+	} else if user.Version != version {
+		return errVersionConflict
+	}
+	profile := newProfileUpdate(user)
+	for name, value := range patch.set {
+		field, _ := lookupProfileField(name)
+		field.set(&profile, value)
+	}
+	for _, name := range patch.unset {
+		field, _ := lookupProfileField(name)
+		field.set(&profile, nil)
+	}
+	profile.applyTo(&user)
+	user.Version++
+	m.users[id] = user
+	return nil
+}
+
+func (m *MemoryStorage) nearbyUsers(ctx context.Context, center GeoPoint, radius float64, limit int, exclude string) ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := make([]User, 0, len(m.users))
+	for id, user := range m.users {
+		if id != exclude {
+			users = append(users, user)
+		}
+	}
+	// ordered so users as near as each other come in the same order
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return nearest(center, radius, limit, users), nil
+}
+
+// NormalizeEmails rewrites every stored email to its canonical form, see
+// Database.NormalizeEmails
+func (m *MemoryStorage) NormalizeEmails(ctx context.Context, normalizer EmailNormalizer, dryRun bool) (EmailNormalizationReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.users))
+	for id := range m.users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	emails := make([]string, len(ids))
+	for i, id := range ids {
+		emails[i] = m.users[id].Email
+	}
+
+	report, changes := planEmailNormalization(emails, normalizer)
+	if dryRun {
+		return report, nil
+	}
+	for i, email := range changes {
+		user := m.users[ids[i]]
+		user.Email = email
+		user.Version++
+		m.users[ids[i]] = user
+	}
+	return report, nil
+}
+
+// The memory storage has no schema, so there is nothing to migrate
+
+func (m *MemoryStorage) Migrate(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryStorage) Rollback(ctx context.Context, steps int) error {
+	return nil
+}
+
+func (m *MemoryStorage) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	return nil, nil
+}
+
+func (m *MemoryStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryStorage) Disconnect(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,124 @@
+package server
+
+// Message catalogs, keyed by locale then by error code or field rule.
+// Errors raised with the english message of their code are translated,
+// others keep the message they were raised with. Field rule messages take
+// the json name of the field as {0}
+var messageCatalogs = map[string]map[string]string{
+	"en": {
+		CodeInvalidPayload:      "Invalid Payload",
+		CodeInvalidJSON:         "The JSON sent is invalid: {0}",
+		CodeValidationFailed:    "Invalid Payload",
+		CodeMethodNotAllowed:    "Method Not allowed",
+		CodeNotFound:            "Resource not found",
+		CodeInternal:            "Something went wrong",
+		CodeTokenMissing:        "Token not passed",
+		CodeTokenMalformed:      "Invalid token format",
+		CodeBasicTokenInvalid:   "Invalid token passed",
+		CodeTokenExpired:        "Token has expired, please login",
+		CodeTokenInvalid:        "Invalid Token",
+		CodeRefreshTokenExpired: "Token has expired, please login",
+		CodeInvalidCredentials:  "Invalid authentication credentials",
+		CodeIncorrectLogin:      "Email/Password is incorrect",
+		CodeIncorrectPassword:   "Current password is incorrect",
+		CodeUserNotFound:        "User does not exist",
+		CodeUserAlreadyExists:   "User already exists, please login",
+		CodePasswordPolicy:      "Password does not meet the security policy",
+		CodeRateLimited:         "Too many requests, please try again later",
+
+		CodePreconditionRequired: "If-Match header is required to update the profile",
+		CodePreconditionFailed:   "Profile was changed since it was read, fetch it again",
+		CodeUpdateConflict:       "Profile was changed by another request, try again",
+		CodeLocationRequired:     "Set your location to find users near you",
+		CodeNotDiscoverable:      "Make yourself discoverable to find users near you",
+
+		CodeEmailUnchanged:           "New email is the current email",
+		CodeEmailInUse:               "Email is already in use",
+		CodeEmailConfirmationInvalid: "Confirmation link is invalid or has expired",
+
+		"field.required":      "{0} is required",
+		"field.email":         "{0} should be a valid email address",
+		"field.eqfield":       "{0} should be the same as {1}",
+		"field.min":           "{0} should be at least {1}",
+		"field.min_length":    "{0} should be at least {1} characters long",
+		"field.max":           "{0} should be at most {1}",
+		"field.max_length":    "{0} should be at most {1} characters long",
+		"field.e164":          "{0} should be a phone number in international format e.g +2348012345678",
+		"field.latitude":      "{0} should be a valid latitude",
+		"field.longitude":     "{0} should be a valid longitude",
+		"field.oneof":         "{0} should be one of [{1}]",
+		"field.invalid":       "{0} is Invalid",
+		"field.uppercase":     "{0} should contain an uppercase letter",
+		"field.lowercase":     "{0} should contain a lowercase letter",
+		"field.digit":         "{0} should contain a digit",
+		"field.symbol":        "{0} should contain a symbol",
+		"field.personal_info": "{0} should not be the same as your email or name",
+		"field.breached":      "{0} is too common or has appeared in a data breach",
+		"field.unknown":       "{0} is not a field that can be updated",
+		"field.string":        "{0} should be a string or null",
+		"field.boolean":       "{0} should be true, false or null",
+		"field.object":        "{0} should be an object or null",
+		"field.number":        "{0} should be a number",
+		"field.geojson_point": "{0} should be a GeoJSON point with a longitude and a latitude",
+		"field.country_code":  "{0} should be an ISO 3166 country code like NG",
+		"field.phone":         "{0} should be a valid phone number, with its country code unless the address has a country",
+	},
+	"fr": {
+		CodeInvalidPayload:      "Données invalides",
+		CodeInvalidJSON:         "Le JSON envoyé est invalide : {0}",
+		CodeValidationFailed:    "Données invalides",
+		CodeMethodNotAllowed:    "Méthode non autorisée",
+		CodeNotFound:            "Ressource introuvable",
+		CodeInternal:            "Une erreur s'est produite",
+		CodeTokenMissing:        "Jeton non fourni",
+		CodeTokenMalformed:      "Format de jeton invalide",
+		CodeBasicTokenInvalid:   "Jeton fourni invalide",
+		CodeTokenExpired:        "Le jeton a expiré, veuillez vous reconnecter",
+		CodeTokenInvalid:        "Jeton invalide",
+		CodeRefreshTokenExpired: "Le jeton a expiré, veuillez vous reconnecter",
+		CodeInvalidCredentials:  "Identifiants d'authentification invalides",
+		CodeIncorrectLogin:      "Email ou mot de passe incorrect",
+		CodeIncorrectPassword:   "Le mot de passe actuel est incorrect",
+		CodeUserNotFound:        "L'utilisateur n'existe pas",
+		CodeUserAlreadyExists:   "L'utilisateur existe déjà, veuillez vous connecter",
+		CodePasswordPolicy:      "Le mot de passe ne respecte pas la politique de sécurité",
+		CodeRateLimited:         "Trop de requêtes, veuillez réessayer plus tard",
+
+		CodePreconditionRequired: "L'en-tête If-Match est obligatoire pour modifier le profil",
+		CodePreconditionFailed:   "Le profil a été modifié entre-temps, veuillez le recharger",
+		CodeUpdateConflict:       "Le profil a été modifié en même temps, veuillez réessayer",
+		CodeLocationRequired:     "Définissez votre position pour trouver les utilisateurs près de vous",
+		CodeNotDiscoverable:      "Rendez-vous visible pour trouver les utilisateurs près de vous",
+
+		CodeEmailUnchanged:           "Le nouvel e-mail est l'e-mail actuel",
+		CodeEmailInUse:               "Cet e-mail est déjà utilisé",
+		CodeEmailConfirmationInvalid: "Le lien de confirmation est invalide ou a expiré",
+
+		"field.required":      "{0} est obligatoire",
+		"field.email":         "{0} doit être une adresse email valide",
+		"field.eqfield":       "{0} doit être identique à {1}",
+		"field.min":           "{0} doit être au moins {1}",
+		"field.min_length":    "{0} doit contenir au moins {1} caractères",
+		"field.max":           "{0} doit être au plus {1}",
+		"field.max_length":    "{0} doit contenir au plus {1} caractères",
+		"field.e164":          "{0} doit être un numéro de téléphone au format international, par exemple +2348012345678",
+		"field.latitude":      "{0} doit être une latitude valide",
+		"field.longitude":     "{0} doit être une longitude valide",
+		"field.oneof":         "{0} doit être l'une des valeurs [{1}]",
+		"field.invalid":       "{0} est invalide",
+		"field.uppercase":     "{0} doit contenir une lettre majuscule",
+		"field.lowercase":     "{0} doit contenir une lettre minuscule",
+		"field.digit":         "{0} doit contenir un chiffre",
+		"field.symbol":        "{0} doit contenir un symbole",
+		"field.personal_info": "{0} ne doit pas être identique à votre email ou votre nom",
+		"field.breached":      "{0} est trop courant ou est apparu dans une fuite de données",
+		"field.unknown":       "{0} n'est pas un champ modifiable",
+		"field.string":        "{0} doit être une chaîne de caractères ou null",
+		"field.boolean":       "{0} doit être true, false ou null",
+		"field.object":        "{0} doit être un objet ou null",
+		"field.number":        "{0} doit être un nombre",
+		"field.geojson_point": "{0} doit être un point GeoJSON avec une longitude et une latitude",
+		"field.country_code":  "{0} doit être un code pays ISO 3166, par exemple NG",
+		"field.phone":         "{0} doit être un numéro de téléphone valide, avec son indicatif sauf si l'adresse a un pays",
+	},
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Path the metrics are scraped from, served without authentication
+const metricsPath = "/metrics"
+
+// metrics holds every collector the server reports, registered on its own
+// registry so several servers can live in one process
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+
+	registrations           prometheus.Counter
+	logins                  *prometheus.CounterVec
+	tokenRefreshes          *prometheus.CounterVec
+	tokenValidationFailures *prometheus.CounterVec
+	passwordHashDuration    *prometheus.HistogramVec
+	storageDuration         *prometheus.HistogramVec
+	rateLimited             *prometheus.CounterVec
+}
+
+// Creates and registers the collectors of a server
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "account_http_requests_total",
+			Help: "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "account_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests by route, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		registrations: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "account_registrations_total",
+			Help: "Users registered.",
+		}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "account_logins_total",
+			Help: "Login attempts by result, success or the reason they failed.",
+		}, []string{"result"}),
+		tokenRefreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "account_token_refreshes_total",
+			Help: "Access token refreshes by result.",
+		}, []string{"result"}),
+		tokenValidationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "account_token_validation_failures_total",
+			Help: "Rejected access and refresh tokens by reason.",
+		}, []string{"token", "reason"}),
+		passwordHashDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "account_password_hash_duration_seconds",
+			Help:    "Time spent in bcrypt hashing and comparing passwords.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"operation"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "account_storage_operation_duration_seconds",
+			Help:    "Latency of storage operations by operation and result.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation", "result"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "account_rate_limited_requests_total",
+			Help: "Requests rejected for going over a rate limit, by policy.",
+		}, []string{"policy"}),
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.registrations,
+		m.logins,
+		m.tokenRefreshes,
+		m.tokenValidationFailures,
+		m.passwordHashDuration,
+		m.storageDuration,
+		m.rateLimited,
+	)
+	return m
+}
+
+// Returns the handler serving the metrics
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// statusRecorder remembers the status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Middleware that counts and times requests. Requests are labelled with the
+// path template of the matched route so ids in paths do not explode the labels
+func (m *metrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		route := routeTemplate(r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		status := strconv.Itoa(recorder.status)
+
+		m.requests.WithLabelValues(route, r.Method, status).Inc()
+		m.requestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Reason a token was rejected, for the validation failure metric
+func tokenFailureReason(err error) string {
+	validationErr, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return "invalid"
+	}
+	switch {
+	case validationErr.Errors&jwt.ValidationErrorExpired != 0:
+		return "expired"
+	case validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return "invalid_signature"
+	case validationErr.Errors&jwt.ValidationErrorMalformed != 0:
+		return "malformed"
+	default:
+		return "invalid"
+	}
+}
+
+// Records a rejected access or refresh token
+func (m *metrics) tokenRejected(token string, err error) {
+	m.tokenValidationFailures.WithLabelValues(token, tokenFailureReason(err)).Inc()
+}
+
+// Returns the result label of an operation
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
@@ -0,0 +1,474 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collections recording the applied migrations and who is running them
+const (
+	migrationsCollection    = "schema_migrations"
+	migrationLockCollection = "schema_migrations_lock"
+)
+
+const (
+	// a lock older than this was left by a runner that died, and is taken over
+	migrationLockTTL = 10 * time.Minute
+
+	// how often the runner holding the lock pushes back its expiry
+	migrationLockRenewal = migrationLockTTL / 3
+
+	// how often a runner waiting for the lock checks it again
+	migrationLockPoll = 500 * time.Millisecond
+)
+
+// Reported when another runner took the migration lock over while migrating
+var errMigrationLockLost = errors.New("lost the migration lock to another runner")
+
+// migration is a versioned change to the collections. down undoes up, a nil
+// down makes the migration irreversible
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, db *mongo.Database) error
+	down    func(ctx context.Context, db *mongo.Database) error
+}
+
+// Every migration, applied in order of version. Versions are never reused
+// or reordered once released, changes go in a new migration
+var migrations = []migration{
+	{1, "create_email_unique_index", createEmailIndex, dropIndex(usersCollection, "email_unique")},
+	{2, "backfill_user_ids", backfillUserIDs, nil},
+	{3, "create_id_unique_index", createIDIndex, dropIndex(usersCollection, "id_unique")},
+	{4, "backfill_user_versions", backfillUserVersions, removeUserVersions},
+	{5, "convert_user_locations", convertUserLocations, restoreUserLocations},
+	{6, "create_location_index", createLocationIndex, dropIndex(usersCollection, "location_2dsphere")},
+	{7, "structure_user_contacts", structureUserContacts, restoreUserContacts},
+}
+
+// MigrationStatus tells whether a migration is applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// A migration as recorded once applied
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+// Migrate applies every migration that is not applied yet, in order. Only
+// one instance migrates at a time, the others wait for it to finish.
+// Migrations can take long so only ctx bounds them, not the operation timeout
+func (d *Database) Migrate(ctx context.Context) error {
+	return d.withMigrationLock(ctx, func(ctx context.Context) error {
+		applied, err := d.appliedMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			if err := m.up(ctx, d.db); err != nil {
+				return fmt.Errorf("migration %d %s failed, %w", m.version, m.name, err)
+			}
+			record := appliedMigration{Version: m.version, Name: m.name, AppliedAt: time.Now().UTC()}
+			if _, err := d.db.Collection(migrationsCollection).InsertOne(ctx, record); err != nil {
+				return fmt.Errorf("could not record migration %d %s, %w", m.version, m.name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Rollback undoes the last steps applied migrations, latest first
+func (d *Database) Rollback(ctx context.Context, steps int) error {
+	return d.withMigrationLock(ctx, func(ctx context.Context) error {
+		applied, err := d.appliedMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.version]; !ok {
+				continue
+			}
+			if m.down == nil {
+				return fmt.Errorf("migration %d %s can not be rolled back", m.version, m.name)
+			}
+			if err := m.down(ctx, d.db); err != nil {
+				return fmt.Errorf("rolling back migration %d %s failed, %w", m.version, m.name, err)
+			}
+			if _, err := d.db.Collection(migrationsCollection).DeleteOne(ctx, bson.M{"_id": m.version}); err != nil {
+				return fmt.Errorf("could not record rollback of migration %d %s, %w", m.version, m.name, err)
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// MigrationStatus reports which migrations are applied
+func (d *Database) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := d.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		record, ok := applied[m.version]
+		statuses = append(statuses, MigrationStatus{Version: m.version, Name: m.name, Applied: ok, AppliedAt: record.AppliedAt})
+	}
+	return statuses, nil
+}
+
+// Returns the recorded migrations keyed by version
+func (d *Database) appliedMigrations(ctx context.Context) (map[int]appliedMigration, error) {
+	cursor, err := d.db.Collection(migrationsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []appliedMigration
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]appliedMigration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// Runs fn holding the migration lock, waiting for it while another runner
+// has it. The lock is renewed while fn runs, the ctx of fn is cancelled if
+// another runner takes it over anyway
+func (d *Database) withMigrationLock(ctx context.Context, fn func(ctx context.Context) error) error {
+	owner := migrationLockOwner()
+	for {
+		locked, err := d.tryMigrationLock(ctx, owner)
+		if err != nil {
+			return fmt.Errorf("could not take the migration lock, %w", err)
+		}
+		if locked {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for the migration lock, %w", ctx.Err())
+		case <-time.After(migrationLockPoll):
+		}
+	}
+	defer d.db.Collection(migrationLockCollection).DeleteOne(context.Background(), bson.M{"_id": "lock", "owner": owner})
+
+	runCtx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+	renewing := make(chan struct{})
+	go func() {
+		defer close(renewing)
+		d.renewMigrationLock(runCtx, owner, migrationLockRenewal, abort)
+	}()
+
+	err := fn(runCtx)
+	abort(nil)
+	<-renewing
+	if cause := context.Cause(runCtx); errors.Is(cause, errMigrationLockLost) {
+		return cause
+	}
+	return err
+}
+
+// Pushes back the expiry of the lock held by owner every interval until ctx
+// is done. Once the lock is no longer held by owner, ctx is cancelled with
+// errMigrationLockLost
+func (d *Database) renewMigrationLock(ctx context.Context, owner string, every time.Duration, abort context.CancelCauseFunc) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		result, err := d.db.Collection(migrationLockCollection).UpdateOne(ctx,
+			bson.M{"_id": "lock", "owner": owner},
+			bson.M{"$set": bson.M{"expires_at": time.Now().UTC().Add(migrationLockTTL)}})
+		if err != nil {
+			// tried again on the next tick, the lock outlives a few failures
+			continue
+		}
+		if result.MatchedCount == 0 {
+			abort(errMigrationLockLost)
+			return
+		}
+	}
+}
+
+// Takes the migration lock if it is free or its holder died
+func (d *Database) tryMigrationLock(ctx context.Context, owner string) (bool, error) {
+	collection := d.db.Collection(migrationLockCollection)
+	now := time.Now().UTC()
+	expires := now.Add(migrationLockTTL)
+
+	_, err := collection.InsertOne(ctx, bson.M{"_id": "lock", "owner": owner, "expires_at": expires})
+	if err == nil {
+		return true, nil
+	}
+	if !isDuplicateKeyError(err) {
+		return false, err
+	}
+
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": "lock", "expires_at": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"owner": owner, "expires_at": expires}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// Identifies this runner in the lock, for whoever finds it held
+func migrationLockOwner() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// Creates the case-insensitive unique index on email
+func createEmailIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(usersCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().
+			SetName("email_unique").
+			SetUnique(true).
+			SetCollation(emailCollation),
+	})
+	if isDuplicateKeyError(err) {
+		return fmt.Errorf("users share an email ignoring case, see the normalize-emails command, %w", err)
+	}
+	return err
+}
+
+// Creates the unique index on the id of users
+func createIDIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(usersCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetName("id_unique").SetUnique(true),
+	})
+	return err
+}
+
+// Returns a migration dropping an index
+func dropIndex(collection, name string) func(context.Context, *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection(collection).Indexes().DropOne(ctx, name)
+		var commandErr mongo.CommandError
+		if errors.As(err, &commandErr) && commandErr.Name == "IndexNotFound" {
+			return nil
+		}
+		return err
+	}
+}
+
+// Gives an id to every user stored before ids existed
+func backfillUserIDs(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection(usersCollection)
+	missing := bson.M{"$or": bson.A{bson.M{"id": bson.M{"$exists": false}}, bson.M{"id": ""}}}
+
+	cursor, err := collection.Find(ctx, missing, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var users []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"id": newUserID()}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gives the first version to every user stored before versions existed
+func backfillUserVersions(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(usersCollection).UpdateMany(ctx,
+		bson.M{"version": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"version": 1}})
+	return err
+}
+
+// Removes the version of every user
+func removeUserVersions(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(usersCollection).UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"version": ""}})
+	return err
+}
+
+// Turns the longitude and latitude strings of users into a GeoJSON point.
+// Coordinates that do not parse or are out of range are left as they are.
+// Users stay undiscoverable until they opt in
+func convertUserLocations(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection(usersCollection)
+	cursor, err := collection.Find(ctx,
+		bson.M{"longitude": bson.M{"$type": "string"}, "latitude": bson.M{"$type": "string"}},
+		options.Find().SetProjection(bson.M{"_id": 1, "longitude": 1, "latitude": 1}))
+	if err != nil {
+		return err
+	}
+	var users []struct {
+		ID        primitive.ObjectID `bson:"_id"`
+		Longitude string             `bson:"longitude"`
+		Latitude  string             `bson:"latitude"`
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		update := bson.M{"$unset": bson.M{"longitude": "", "latitude": ""}}
+		if user.Longitude != "" || user.Latitude != "" {
+			longitude, lngErr := strconv.ParseFloat(user.Longitude, 64)
+			latitude, latErr := strconv.ParseFloat(user.Latitude, 64)
+			location := newGeoPoint(longitude, latitude)
+			if lngErr != nil || latErr != nil || validate.Struct(location) != nil {
+				continue
+			}
+			update["$set"] = bson.M{"location": location}
+		}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": user.ID}, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Turns the location of users back into longitude and latitude strings
+func restoreUserLocations(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection(usersCollection)
+	cursor, err := collection.Find(ctx, bson.M{"location": bson.M{"$type": "object"}},
+		options.Find().SetProjection(bson.M{"_id": 1, "location": 1}))
+	if err != nil {
+		return err
+	}
+	var users []struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		Location GeoPoint           `bson:"location"`
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if len(user.Location.Coordinates) != 2 {
+			continue
+		}
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{
+			"$set": bson.M{
+				"longitude": strconv.FormatFloat(user.Location.longitude(), 'f', -1, 64),
+				"latitude":  strconv.FormatFloat(user.Location.latitude(), 'f', -1, 64),
+			},
+			"$unset": bson.M{"location": ""},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = collection.UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"location": "", "discoverable": ""}})
+	return err
+}
+
+// Creates the index finding users near a point
+func createLocationIndex(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(usersCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "location", Value: "2dsphere"}},
+		Options: options.Index().SetName("location_2dsphere"),
+	})
+	return err
+}
+
+// Structures the phone number and address of every user, see
+// convertLegacyContact. Users with a structured address are already done
+func structureUserContacts(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection(usersCollection)
+	cursor, err := collection.Find(ctx, bson.M{"address": bson.M{"$not": bson.M{"$type": "object"}}},
+		options.Find().SetProjection(bson.M{"_id": 1, "phonenumber": 1, "useraddress": 1}))
+	if err != nil {
+		return err
+	}
+	var users []struct {
+		ID          primitive.ObjectID `bson:"_id"`
+		PhoneNumber string             `bson:"phonenumber"`
+		UserAddress string             `bson:"useraddress"`
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		contact := convertLegacyContact(user.PhoneNumber, user.UserAddress)
+		if contact.phone == user.PhoneNumber && contact.address == nil && contact.unparsed == nil {
+			continue
+		}
+		set := bson.M{"phonenumber": contact.phone}
+		if contact.address != nil {
+			set["address"] = contact.address
+		}
+		if contact.unparsed != nil {
+			set["unparsed"] = contact.unparsed
+		}
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": set, "$inc": bson.M{"version": 1}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Puts back the phone numbers that did not parse and removes the
+// structured addresses
+func restoreUserContacts(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection(usersCollection)
+	cursor, err := collection.Find(ctx, bson.M{"unparsed.phone_number": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"_id": 1, "unparsed": 1}))
+	if err != nil {
+		return err
+	}
+	var users []struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		Unparsed map[string]string  `bson:"unparsed"`
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"phonenumber": user.Unparsed["phone_number"]}})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = collection.UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"address": "", "unparsed": ""}})
+	return err
+}
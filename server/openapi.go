@@ -0,0 +1,399 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//go:embed docs
+var docsAssets embed.FS
+
+// Paths the api description and its docs page are served on
+const (
+	openAPIPath = "/api/openapi.json"
+	docsPath    = "/api/docs"
+)
+
+// Security requirement of an operation
+const (
+	securityNone       = ""
+	securityBasicToken = "basicToken"
+	securityBearerJWT  = "bearerJWT"
+)
+
+// operation describes one method of a route for the api description.
+// request and response are values of the types the handler decodes
+// and returns as the data of a SuccessResponse
+type operation struct {
+	method   string
+	summary  string
+	security string
+	request  interface{}
+	response interface{}
+	errors   []int
+}
+
+// Operations of version 1 of the api, keyed by the path in v1Routes
+func v1Operations() map[string][]operation {
+	return map[string][]operation{
+		"/register": {
+			{http.MethodPost, "Register a user", securityBasicToken, RegisterUser{}, loginResponse{},
+				[]int{http.StatusBadRequest, http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusConflict, http.StatusTooManyRequests}},
+		},
+		"/login": {
+			{http.MethodPost, "Login a user", securityBasicToken, loginInfo{}, loginResponse{},
+				[]int{http.StatusBadRequest, http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusTooManyRequests}},
+		},
+		"/profile": {
+			{http.MethodGet, "Retrieve the profile of the logged in user", securityBearerJWT, nil, User{},
+				[]int{http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests}},
+			{http.MethodPut, "Replace the profile of the logged in user", securityBearerJWT, profileUpdate{}, User{},
+				[]int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict,
+					http.StatusPreconditionFailed, http.StatusPreconditionRequired, http.StatusTooManyRequests}},
+			{http.MethodPatch, "Update the profile of the logged in user with a JSON merge patch, null clears a field", securityBearerJWT, profileUpdate{}, User{},
+				[]int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict,
+					http.StatusPreconditionFailed, http.StatusPreconditionRequired, http.StatusTooManyRequests}},
+		},
+		"/profile/password": {
+			{http.MethodPost, "Change the password of the logged in user", securityBearerJWT, passwordChange{}, nil,
+				[]int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusConflict, http.StatusTooManyRequests}},
+		},
+		"/profile/email": {
+			{http.MethodPost, "Request a change of the email of the logged in user, confirmed with a link sent to the new email",
+				securityBearerJWT, emailChange{}, nil,
+				[]int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusConflict, http.StatusTooManyRequests}},
+		},
+		"/users/nearby": {
+			{http.MethodGet, "Find the discoverable users near the logged in user, when enabled", securityBearerJWT, nearbyQuery{}, []nearbyUser{},
+				[]int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusTooManyRequests}},
+		},
+		emailConfirmPath: {
+			{http.MethodGet, "Show the email change of the link sent to the new email, with the token a POST confirms it with. Browsers get a page whose form does", securityNone, emailConfirmation{}, pendingEmailChange{},
+				[]int{http.StatusBadRequest, http.StatusTooManyRequests}},
+			{http.MethodPost, "Confirm an email change with the token shown by a GET of the link sent to the new email", securityNone, emailConfirmation{}, User{},
+				[]int{http.StatusBadRequest, http.StatusMethodNotAllowed, http.StatusConflict, http.StatusTooManyRequests}},
+		},
+		"/refresh-token": {
+			{http.MethodPost, "Get a new access token from a refresh token", securityNone, tokenDetails{}, tokenDetails{},
+				[]int{http.StatusBadRequest, http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusTooManyRequests}},
+		},
+	}
+}
+
+type jsonObject map[string]interface{}
+
+// Builds OpenAPI schemas from go types, collecting named structs as components
+type schemaBuilder struct {
+	components jsonObject
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Name of the component a struct type is published as
+func componentName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+// Returns the schema of a type, named structs are referenced
+func (b *schemaBuilder) schema(t reflect.Type) jsonObject {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return jsonObject{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		name := componentName(t)
+		if _, ok := b.components[name]; !ok {
+			// reserve the name first so recursive types terminate
+			b.components[name] = nil
+			b.components[name] = b.object(t)
+		}
+		return jsonObject{"$ref": "#/components/schemas/" + name}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonObject{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return jsonObject{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		return b.object(t)
+	}
+	return jsonObject{}
+}
+
+// Returns the object schema of a struct from its json and validate tags
+func (b *schemaBuilder) object(t reflect.Type) jsonObject {
+	properties := jsonObject{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property := b.schema(field.Type)
+		rules := strings.Split(field.Tag.Get("validate"), ",")
+		for _, rule := range rules {
+			if rule == "required" {
+				required = append(required, name)
+			}
+		}
+		if _, isRef := property["$ref"]; !isRef {
+			applyValidationRules(property, rules)
+		}
+		properties[name] = property
+	}
+
+	schema := jsonObject{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// Describes the fields of a struct as query parameters
+func (b *schemaBuilder) queryParameters(t reflect.Type) []jsonObject {
+	object := b.object(t)
+	required := map[string]bool{}
+	if names, ok := object["required"].([]string); ok {
+		for _, name := range names {
+			required[name] = true
+		}
+	}
+
+	properties := object["properties"].(jsonObject)
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parameters := make([]jsonObject, 0, len(names))
+	for _, name := range names {
+		parameters = append(parameters, jsonObject{
+			"name":     name,
+			"in":       "query",
+			"required": required[name],
+			"schema":   properties[name],
+		})
+	}
+	return parameters
+}
+
+// Describes validate tag rules in a schema
+func applyValidationRules(schema jsonObject, rules []string) {
+	isString := schema["type"] == "string"
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		param := ""
+		if len(parts) == 2 {
+			param = parts[1]
+		}
+
+		switch parts[0] {
+		case "email":
+			schema["format"] = "email"
+		case "e164":
+			schema["pattern"] = `^\+[1-9][0-9]{1,14}$`
+		case "country_code":
+			schema["pattern"] = `^[A-Z]{2}$`
+		case "latitude", "longitude":
+			schema["description"] = "a " + parts[0] + " in decimal degrees"
+		case "oneof":
+			schema["enum"] = strings.Fields(param)
+		case "min", "max":
+			if !isString {
+				continue
+			}
+			n := json.Number(param)
+			if parts[0] == "min" {
+				schema["minLength"] = n
+			} else {
+				schema["maxLength"] = n
+			}
+		}
+	}
+}
+
+// Returns the schema of a success response wrapping data
+func (b *schemaBuilder) envelope(data interface{}) jsonObject {
+	dataSchema := jsonObject{"nullable": true}
+	if data != nil {
+		dataSchema = b.schema(reflect.TypeOf(data))
+	}
+	return jsonObject{
+		"type": "object",
+		"properties": jsonObject{
+			"message": jsonObject{"type": "string"},
+			"data":    dataSchema,
+		},
+		"required": []string{"data", "message"},
+	}
+}
+
+// Paths whose resource is tagged with an ETag, updates of it are
+// conditional on If-Match
+var taggedPaths = map[string]bool{"/profile": true}
+
+// Describes an operation of the api
+func (b *schemaBuilder) operation(op operation, tagged, deprecated bool) jsonObject {
+	success := jsonObject{
+		"description": "success",
+		"content":     jsonObject{jsonContentType: jsonObject{"schema": b.envelope(op.response)}},
+	}
+	if tagged {
+		success["headers"] = jsonObject{
+			"ETag": jsonObject{"description": "version of the resource", "schema": jsonObject{"type": "string"}},
+		}
+	}
+	responses := jsonObject{"200": success}
+	for _, status := range append(op.errors, http.StatusInternalServerError) {
+		responses[strconv.Itoa(status)] = jsonObject{"$ref": "#/components/responses/Error"}
+	}
+
+	described := jsonObject{
+		"summary":   op.summary,
+		"responses": responses,
+	}
+	if op.request != nil && op.method == http.MethodGet {
+		described["parameters"] = b.queryParameters(reflect.TypeOf(op.request))
+	} else if op.request != nil {
+		contentType := jsonContentType
+		if op.method == http.MethodPatch {
+			contentType = mergePatchContentType
+		}
+		described["requestBody"] = jsonObject{
+			"required": true,
+			"content": jsonObject{
+				contentType: jsonObject{"schema": b.schema(reflect.TypeOf(op.request))},
+			},
+		}
+	}
+	if tagged && op.method != http.MethodGet {
+		described["parameters"] = []jsonObject{{
+			"name":        "If-Match",
+			"in":          "header",
+			"description": "ETag of the version the update is made against, required unless configured otherwise",
+			"schema":      jsonObject{"type": "string"},
+		}}
+	}
+	if op.security != securityNone {
+		described["security"] = []jsonObject{{op.security: []string{}}}
+	}
+	if deprecated {
+		described["deprecated"] = true
+	}
+	return described
+}
+
+// Describes every route of the api as an OpenAPI 3 document
+func newOpenAPISpec() jsonObject {
+	b := &schemaBuilder{components: jsonObject{}}
+	b.schema(reflect.TypeOf(APIError{}))
+	b.schema(reflect.TypeOf(problemDetails{}))
+
+	paths := jsonObject{}
+	for path, ops := range v1Operations() {
+		current, legacy := jsonObject{}, jsonObject{}
+		for _, op := range ops {
+			current[strings.ToLower(op.method)] = b.operation(op, taggedPaths[path], false)
+			legacy[strings.ToLower(op.method)] = b.operation(op, taggedPaths[path], true)
+		}
+		paths[apiV1Prefix+path] = current
+		paths[legacyPrefix+path] = legacy
+	}
+
+	return jsonObject{
+		"openapi": "3.0.3",
+		"info": jsonObject{
+			"title":       "Account",
+			"description": "Account service for everything related to the account of a user",
+			"version":     "1.0.0",
+		},
+		"paths": paths,
+		"components": jsonObject{
+			"schemas": b.components,
+			"responses": jsonObject{
+				"Error": jsonObject{
+					"description": "error",
+					"content": jsonObject{
+						jsonContentType:        jsonObject{"schema": jsonObject{"$ref": "#/components/schemas/APIError"}},
+						problemJSONContentType: jsonObject{"schema": jsonObject{"$ref": "#/components/schemas/ProblemDetails"}},
+					},
+				},
+			},
+			"securitySchemes": jsonObject{
+				securityBasicToken: jsonObject{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "The basic token shared with api clients",
+				},
+				securityBearerJWT: jsonObject{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+					"description":  "The access token returned on register or login",
+				},
+			},
+		},
+	}
+}
+
+// Endpoint serving the OpenAPI description of the api
+func OpenAPI(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		jsonResp, err := json.Marshal(newOpenAPISpec())
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		w.Header().Set("Content-Type", jsonContentType)
+		w.Write(jsonResp)
+
+	default:
+		MethodNotAllowedResponse(w, req)
+	}
+}
+
+// Returns a handler serving the docs page of the api
+func docsHandler() http.Handler {
+	assets, err := fs.Sub(docsAssets, "docs")
+	if err != nil {
+		log.Fatalln("Docs assets are not embedded", err)
+	}
+	return http.StripPrefix(docsPath, http.FileServer(http.FS(assets)))
+}
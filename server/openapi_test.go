@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+var updateSpec = flag.Bool("update", false, "rewrite testdata/openapi.json from the handler types")
+
+// The published description must only change deliberately, a request or
+// response type drifting from it fails here until the file is regenerated
+// with go test ./server -run TestOpenAPISpec -update
+func TestOpenAPISpec(t *testing.T) {
+	generated, err := json.MarshalIndent(newOpenAPISpec(), "", "  ")
+	if err != nil {
+		t.Fatal("Could not marshal the OpenAPI description, ", err)
+	}
+	generated = append(generated, '\n')
+
+	golden := filepath.Join("testdata", "openapi.json")
+	if *updateSpec {
+		if err := ioutil.WriteFile(golden, generated, 0644); err != nil {
+			t.Fatal("Could not update the OpenAPI description, ", err)
+		}
+	}
+
+	published, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal("Could not read the published OpenAPI description, ", err)
+	}
+	if !bytes.Equal(published, generated) {
+		t.Fatal("Handler types drifted from testdata/openapi.json, regenerate it with -update and review the diff")
+	}
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	s := newTestServer(t)
+	ops := v1Operations()
+	for _, r := range s.v1Routes() {
+		if len(ops[r.path]) == 0 {
+			t.Fatalf("Route %s is not described in the OpenAPI description", r.path)
+		}
+		delete(ops, r.path)
+	}
+	for path := range ops {
+		t.Fatalf("OpenAPI description has %s which is not routed", path)
+	}
+
+	req, err := http.NewRequest("GET", openAPIPath, nil)
+	if err != nil {
+		t.Fatal("Could not create request with error ", err)
+	}
+	rr := httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, req)
+
+	var spec map[string]interface{}
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &spec) != nil {
+		t.Fatalf("OpenAPI description was not served, %d %s", rr.Code, rr.Body.String())
+	}
+	if spec["openapi"] != "3.0.3" {
+		t.Fatal("Served an unexpected document, ", spec["openapi"])
+	}
+
+	req, err = http.NewRequest("GET", docsPath+"/", nil)
+	if err != nil {
+		t.Fatal("Could not create request with error ", err)
+	}
+	rr = httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !bytes.Contains(rr.Body.Bytes(), []byte("Account API")) {
+		t.Fatalf("Docs page was not served, %d", rr.Code)
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bcrypt ignores everything after the first 72 bytes of a password
+const bcryptMaxPasswordBytes = 72
+
+// PasswordPolicy describes what a password must look like before it is hashed.
+// It applies everywhere a password is set
+type PasswordPolicy struct {
+	MinLength            int
+	MaxLength            int
+	RequireUpper         bool
+	RequireLower         bool
+	RequireDigit         bool
+	RequireSymbol        bool
+	DisallowPersonalInfo bool
+	Breached             *BreachedPasswords
+}
+
+// DefaultPasswordPolicy returns the policy used when nothing is configured
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:            8,
+		MaxLength:            bcryptMaxPasswordBytes,
+		DisallowPersonalInfo: true,
+		Breached:             commonPasswordList,
+	}
+}
+
+// Checks that the policy itself makes sense
+func (p PasswordPolicy) validate() error {
+	if p.MinLength < 1 {
+		return fmt.Errorf("password minimum length should be at least 1, got %d", p.MinLength)
+	}
+	if p.MaxLength > bcryptMaxPasswordBytes {
+		return fmt.Errorf("password maximum length can not exceed %d bytes", bcryptMaxPasswordBytes)
+	}
+	if p.MaxLength < p.MinLength {
+		return fmt.Errorf("password maximum length %d is below the minimum length %d", p.MaxLength, p.MinLength)
+	}
+	return nil
+}
+
+// Check returns a non nil *APIError describing the first rule the password
+// breaks. field is the json name the password was sent as, the personal
+// values (email, first name, ...) may not be used as the password
+func (p PasswordPolicy) Check(field, password string, personal ...string) error {
+	violation := func(rule, key string, params ...string) error {
+		fieldErr := newFieldError(rule, key, append([]string{field}, params...)...)
+		apiErr := newAPIError(http.StatusBadRequest, CodePasswordPolicy, fieldErr.Message)
+		apiErr.Fields = map[string]FieldError{field: fieldErr}
+		return apiErr
+	}
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return violation("min", "field.min_length", strconv.Itoa(p.MinLength))
+	}
+	if len(password) > p.MaxLength {
+		return violation("max", "field.max_length", strconv.Itoa(p.MaxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	switch {
+	case p.RequireUpper && !hasUpper:
+		return violation("uppercase", "field.uppercase")
+	case p.RequireLower && !hasLower:
+		return violation("lowercase", "field.lowercase")
+	case p.RequireDigit && !hasDigit:
+		return violation("digit", "field.digit")
+	case p.RequireSymbol && !hasSymbol:
+		return violation("symbol", "field.symbol")
+	}
+
+	if p.DisallowPersonalInfo {
+		for _, value := range personal {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			local := strings.Split(value, "@")[0]
+			if strings.EqualFold(password, value) || strings.EqualFold(password, local) {
+				return violation("personal_info", "field.personal_info")
+			}
+		}
+	}
+
+	if p.Breached.Contains(password) {
+		return violation("breached", "field.breached")
+	}
+	return nil
+}
+
+// BreachedPasswords is an offline set of exposed passwords. Passwords are
+// stored as upper case SHA-1 hashes indexed by their first five characters
+// so lookups only ever compare a hash prefix range, like the
+// haveibeenpwned range API
+type BreachedPasswords struct {
+	ranges map[string]map[string]struct{}
+}
+
+// Hash prefix length used to bucket breached passwords
+const breachedPrefixLength = 5
+
+// Returns the upper case hex SHA-1 of a password
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// NewBreachedPasswords builds a list from plain text passwords
+func NewBreachedPasswords(passwords ...string) *BreachedPasswords {
+	list := &BreachedPasswords{ranges: make(map[string]map[string]struct{})}
+	for _, password := range passwords {
+		list.addHash(sha1Hex(password))
+	}
+	return list
+}
+
+// Adds an upper case SHA-1 hash to the list
+func (b *BreachedPasswords) addHash(hash string) {
+	prefix, suffix := hash[:breachedPrefixLength], hash[breachedPrefixLength:]
+	if b.ranges[prefix] == nil {
+		b.ranges[prefix] = make(map[string]struct{})
+	}
+	b.ranges[prefix][suffix] = struct{}{}
+}
+
+// LoadBreachedPasswords reads a list from a file. Each line is either a
+// SHA-1 hash, optionally followed by ":count" as in the haveibeenpwned
+// downloads, or a plain text password
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open breached passwords file, %w", err)
+	}
+	defer file.Close()
+
+	list, err := readBreachedPasswords(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read breached passwords file, %w", err)
+	}
+	return list, nil
+}
+
+// Reads a breached password list, one entry per line
+func readBreachedPasswords(r io.Reader) (*BreachedPasswords, error) {
+	list := NewBreachedPasswords()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if hash := strings.ToUpper(strings.Split(line, ":")[0]); isSHA1Hex(hash) {
+			list.addHash(hash)
+			continue
+		}
+		list.addHash(sha1Hex(line))
+	}
+	return list, scanner.Err()
+}
+
+// Checks if a string is a hex encoded SHA-1 hash
+func isSHA1Hex(s string) bool {
+	if len(s) != sha1.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Range returns the hash suffixes of every breached password whose
+// SHA-1 hash starts with prefix
+func (b *BreachedPasswords) Range(prefix string) []string {
+	if b == nil {
+		return nil
+	}
+	suffixes := make([]string, 0, len(b.ranges[strings.ToUpper(prefix)]))
+	for suffix := range b.ranges[strings.ToUpper(prefix)] {
+		suffixes = append(suffixes, suffix)
+	}
+	return suffixes
+}
+
+// Contains checks if the password is in the list, only the hash
+// prefix is used to select the candidates
+func (b *BreachedPasswords) Contains(password string) bool {
+	hash := sha1Hex(password)
+	for _, suffix := range b.Range(hash[:breachedPrefixLength]) {
+		if suffix == hash[breachedPrefixLength:] {
+			return true
+		}
+	}
+	return false
+}
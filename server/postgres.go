@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// Key of the postgres advisory lock held while migrating, "account" in hex
+const postgresMigrationLock = 0x6163636f756e74
+
+// Every postgres migration, applied in order of version. Versions are never
+// reused or reordered once released, changes go in a new migration
+var postgresMigrations = []sqlMigration{
+	{1, "create_users", `
+		CREATE TABLE users (
+			id              text PRIMARY KEY,
+			email           text NOT NULL,
+			hashed_password text NOT NULL DEFAULT '',
+			first_name      text NOT NULL DEFAULT '',
+			phone_number    text NOT NULL DEFAULT '',
+			user_address    text NOT NULL DEFAULT '',
+			is_active       boolean NOT NULL DEFAULT false,
+			date_joined     timestamptz NOT NULL,
+			last_login      timestamptz NOT NULL,
+			longitude       text NOT NULL DEFAULT '',
+			latitude        text NOT NULL DEFAULT '',
+			device_id       text NOT NULL DEFAULT ''
+		)`,
+		`DROP TABLE users`, nil},
+	{2, "create_email_unique_index",
+		`CREATE UNIQUE INDEX users_email_unique ON users (lower(email))`,
+		`DROP INDEX users_email_unique`, nil},
+	{3, "add_user_version",
+		`ALTER TABLE users ADD COLUMN version bigint NOT NULL DEFAULT 1`,
+		`ALTER TABLE users DROP COLUMN version`, nil},
+	// the text columns keep the coordinates that do not convert, so rolling
+	// back loses nothing
+	{4, "add_user_location", `
+		ALTER TABLE users
+			ADD COLUMN location_longitude double precision,
+			ADD COLUMN location_latitude  double precision,
+			ADD COLUMN discoverable       boolean NOT NULL DEFAULT false;
+		UPDATE users SET
+			location_longitude = CAST(longitude AS double precision),
+			location_latitude  = CAST(latitude AS double precision)
+			WHERE longitude ~ '^[-+]?[0-9]+(\.[0-9]+)?$' AND latitude ~ '^[-+]?[0-9]+(\.[0-9]+)?$';
+		UPDATE users SET location_longitude = NULL, location_latitude = NULL
+			WHERE location_longitude NOT BETWEEN -180 AND 180 OR location_latitude NOT BETWEEN -90 AND 90;
+		UPDATE users SET longitude = '', latitude = '' WHERE location_longitude IS NOT NULL;
+		CREATE INDEX users_location ON users (location_latitude)`, `
+		UPDATE users SET
+			longitude = CAST(location_longitude AS text),
+			latitude  = CAST(location_latitude AS text)
+			WHERE location_longitude IS NOT NULL;
+		DROP INDEX users_location;
+		ALTER TABLE users DROP COLUMN location_longitude, DROP COLUMN location_latitude, DROP COLUMN discoverable`, nil},
+	{5, "structure_user_contacts", `
+		ALTER TABLE users ADD COLUMN address text, ADD COLUMN unparsed text`, `
+		UPDATE users SET phone_number = CAST(unparsed AS jsonb) ->> 'phone_number'
+			WHERE CAST(unparsed AS jsonb) ->> 'phone_number' IS NOT NULL;
+		ALTER TABLE users DROP COLUMN address, DROP COLUMN unparsed`,
+		convertSQLUserContacts},
+}
+
+var postgresDialect = sqlDialect{
+	migrations: postgresMigrations,
+
+	// the advisory lock goes with the connection, so a runner that dies
+	// releases it
+	lockMigrations: func(ctx context.Context, conn *sql.Conn) (func(), error) {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresMigrationLock); err != nil {
+			return nil, err
+		}
+		return func() {
+			conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, postgresMigrationLock)
+		}, nil
+	},
+	uniqueViolation: func(err error) bool {
+		return postgresErrorCode(err) == "23505"
+	},
+	undefinedTable: func(err error) bool {
+		return postgresErrorCode(err) == "42P01"
+	},
+	forUpdate: " FOR UPDATE",
+}
+
+// Returns the SQLSTATE code of a postgres error, empty for other errors
+func postgresErrorCode(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// Postgres is a pool of connections to the postgres database holding the
+// accounts
+type Postgres struct {
+	sqlStorage
+}
+
+// ConnectPostgres connects to the configured postgres database. Failed
+// attempts are retried like ConnectDatabase does
+func ConnectPostgres(ctx context.Context, cfg Config, logger *slog.Logger) (*Postgres, error) {
+	db, err := sql.Open("pgx", cfg.PostgresURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid postgres_url, %w", err)
+	}
+	db.SetMaxOpenConns(cfg.PostgresMaxConns)
+	db.SetMaxIdleConns(cfg.PostgresMaxConns)
+
+	err = connectWithRetries(ctx, logger, cfg.PostgresConnectRetries, cfg.PostgresRetryBackoff, func() error {
+		ctx, cancel := context.WithTimeout(ctx, cfg.PostgresConnectTimeout)
+		defer cancel()
+		return db.PingContext(ctx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	logger.Info("Connected to PostgreSQL")
+	return &Postgres{sqlStorage{db: db, dialect: postgresDialect, timeout: cfg.PostgresOperationTimeout}}, nil
+}
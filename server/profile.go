@@ -0,0 +1,338 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Media type of a JSON merge patch (RFC 7396), PATCH also accepts plain json
+const mergePatchContentType = "application/merge-patch+json"
+
+// profileUpdate holds the fields of a profile its user can change, and the
+// ones derived from them
+type profileUpdate struct {
+	FirstName   string `json:"first_name" validate:"max=50"`
+	PhoneNumber string `json:"phone_number" validate:"omitempty,e164"`
+	DeviceID    string `json:"device_id" validate:"max=255"`
+
+	Address      *Address  `json:"address"`
+	Location     *GeoPoint `json:"location"`
+	Discoverable bool      `json:"discoverable"`
+
+	// the address on one line, older clients change it instead of the address
+	UserAddress string            `json:"user_address"`
+	Unparsed    map[string]string `json:"-"`
+}
+
+// profileField is a field of profileUpdate. name is its key in a patch and
+// its sql column, bson its key in mongo. value points to the field
+type profileField struct {
+	name  string
+	bson  string
+	value func(p *profileUpdate) interface{}
+}
+
+var profileFields = []profileField{
+	{"first_name", "firstname", func(p *profileUpdate) interface{} { return &p.FirstName }},
+	{"phone_number", "phonenumber", func(p *profileUpdate) interface{} { return &p.PhoneNumber }},
+	{"device_id", "deviceid", func(p *profileUpdate) interface{} { return &p.DeviceID }},
+	{"address", "address", func(p *profileUpdate) interface{} { return &p.Address }},
+	{"location", "location", func(p *profileUpdate) interface{} { return &p.Location }},
+	{"discoverable", "discoverable", func(p *profileUpdate) interface{} { return &p.Discoverable }},
+	{"user_address", "useraddress", func(p *profileUpdate) interface{} { return &p.UserAddress }},
+}
+
+// Fields of profileUpdate set from the others by normalize, a patch can
+// not change them
+var derivedProfileFields = []profileField{
+	{"unparsed", "unparsed", func(p *profileUpdate) interface{} { return &p.Unparsed }},
+}
+
+// Returns the value of the field in a profile
+func (f profileField) get(p *profileUpdate) interface{} {
+	return reflect.ValueOf(f.value(p)).Elem().Interface()
+}
+
+// Sets the field in a profile, nil clears it
+func (f profileField) set(p *profileUpdate, value interface{}) {
+	field := reflect.ValueOf(f.value(p)).Elem()
+	if value == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return
+	}
+	field.Set(reflect.ValueOf(value))
+}
+
+// Returns the value of the field once cleared
+func (f profileField) cleared() interface{} {
+	return f.get(&profileUpdate{})
+}
+
+// Returns the json type the field is written as in a patch
+func (f profileField) jsonType() string {
+	switch reflect.TypeOf(f.value(&profileUpdate{})).Elem().Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Ptr, reflect.Struct, reflect.Map:
+		return "object"
+	default:
+		return "string"
+	}
+}
+
+// Returns the profile field named name in a patch, derived or not
+func lookupProfileField(name string) (profileField, bool) {
+	if field, ok := lookupEditableField(name); ok {
+		return field, true
+	}
+	for _, field := range derivedProfileFields {
+		if field.name == name {
+			return field, true
+		}
+	}
+	return profileField{}, false
+}
+
+// Returns the profile field named name if its user can change it
+func lookupEditableField(name string) (profileField, bool) {
+	for _, field := range profileFields {
+		if field.name == name {
+			return field, true
+		}
+	}
+	return profileField{}, false
+}
+
+// userPatch changes some profile fields of a user, keyed by their name in
+// profileFields. Each field is set to a new value or cleared
+type userPatch struct {
+	set   map[string]interface{}
+	unset []string
+}
+
+func (p userPatch) empty() bool {
+	return len(p.set) == 0 && len(p.unset) == 0
+}
+
+// Returns the editable fields of a user
+func newProfileUpdate(user User) profileUpdate {
+	return profileUpdate{
+		FirstName:   user.FirstName,
+		PhoneNumber: user.PhoneNumber,
+		DeviceID:    user.DeviceID,
+
+		Address:      user.Address,
+		Location:     user.Location,
+		Discoverable: user.Discoverable,
+
+		UserAddress: user.UserAddress,
+		Unparsed:    user.Unparsed,
+	}
+}
+
+// Copies the editable fields to a user
+func (p profileUpdate) applyTo(user *User) {
+	user.FirstName = p.FirstName
+	user.PhoneNumber = p.PhoneNumber
+	user.DeviceID = p.DeviceID
+	user.Address = p.Address
+	user.Location = p.Location
+	user.Discoverable = p.Discoverable
+	user.UserAddress = p.UserAddress
+	user.Unparsed = p.Unparsed
+}
+
+// Applies a merge patch to a profile: a field set to null is cleared and a
+// field that is left out is kept. Fields that can not be updated are
+// rejected, and objects are replaced as a whole. A changed user_address
+// without an address replaces the address, like it does in a PUT
+func mergeProfilePatch(profile profileUpdate, body []byte) (profileUpdate, error) {
+	current := profile
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return profile, err
+	}
+	if patch == nil {
+		return profile, newAPIError(http.StatusBadRequest, CodeInvalidPayload, "Invalid Payload")
+	}
+
+	names := make([]string, 0, len(patch))
+	for name := range patch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := make(map[string]FieldError)
+	for _, name := range names {
+		field, ok := lookupEditableField(name)
+		if !ok {
+			problems[name] = newFieldError("unknown", "field.unknown", name)
+			continue
+		}
+		// cleared first so objects are not decoded into the current value
+		field.set(&profile, nil)
+		if bytes.Equal(patch[name], []byte("null")) {
+			continue
+		}
+		if err := json.Unmarshal(patch[name], field.value(&profile)); err != nil {
+			kind := field.jsonType()
+			problems[name] = newFieldError(kind, "field."+kind, name)
+		}
+	}
+
+	if len(problems) > 0 {
+		apiErr := newAPIError(http.StatusBadRequest, CodeValidationFailed, "Invalid Payload")
+		apiErr.Fields = problems
+		if len(problems) == 1 {
+			for _, problem := range problems {
+				apiErr.Message = problem.Message
+			}
+		}
+		return profile, apiErr
+	}
+
+	_, legacyAddress := patch["user_address"]
+	if _, ok := patch["address"]; legacyAddress && !ok && profile.UserAddress != current.UserAddress {
+		profile.Address = nil
+	}
+	return profile, nil
+}
+
+// Returns the changes turning a profile into updated
+func diffProfile(profile, updated profileUpdate) userPatch {
+	patch := userPatch{set: make(map[string]interface{})}
+	for _, field := range append(profileFields, derivedProfileFields...) {
+		before, after := field.get(&profile), field.get(&updated)
+		switch {
+		case reflect.DeepEqual(before, after):
+		case reflect.ValueOf(after).IsZero():
+			patch.unset = append(patch.unset, field.name)
+		default:
+			patch.set[field.name] = after
+		}
+	}
+	return patch
+}
+
+// Returns the ETag of a profile, its version
+func userETag(user User) string {
+	return strconv.Quote(strconv.FormatInt(user.Version, 10))
+}
+
+// Checks if an If-Match header matches etag. Only strong tags are compared,
+// a weak tag never matches
+func etagMatches(ifMatch, etag string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that a request updating the profile of user was made against its
+// current version. Without If-Match the update overwrites whatever changed,
+// unless the header is required. Legacy routes never require it, their
+// clients predate ETags
+func (s *Server) checkIfMatch(req *http.Request, user User) error {
+	ifMatch := strings.Join(req.Header.Values("If-Match"), ",")
+	if ifMatch == "" {
+		if s.cfg.RequireIfMatch && strings.HasPrefix(req.URL.Path, apiV1Prefix+"/") {
+			return newAPIError(http.StatusPreconditionRequired, CodePreconditionRequired, "If-Match header is required to update the profile")
+		}
+		return nil
+	}
+	if !etagMatches(ifMatch, userETag(user)) {
+		return preconditionFailed()
+	}
+	return nil
+}
+
+func preconditionFailed() *APIError {
+	return newAPIError(http.StatusPreconditionFailed, CodePreconditionFailed, "Profile was changed since it was read, fetch it again")
+}
+
+// Returns the error for an update that lost against a concurrent one. With
+// If-Match the precondition failed, otherwise the client can just retry
+func updateConflict(req *http.Request, err error) error {
+	if !errors.Is(err, errVersionConflict) {
+		return err
+	}
+	if req.Header.Get("If-Match") != "" {
+		return preconditionFailed()
+	}
+	return newAPIError(http.StatusConflict, CodeUpdateConflict, "Profile was changed by another request, try again")
+}
+
+// Updates the profile of the logged in user with a merge patch, only the
+// fields that change are written
+func (s *Server) patchProfile(w http.ResponseWriter, req *http.Request, user User) {
+	if err := s.checkIfMatch(req, user); err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(req.Body); err != nil {
+		InvalidJsonResp(w, req, err)
+		return
+	}
+	if body.Len() == 0 {
+		writeError(w, req, newAPIError(http.StatusBadRequest, CodeInvalidPayload, "Invalid Payload"))
+		return
+	}
+
+	current := newProfileUpdate(user)
+	updated, err := mergeProfilePatch(current, body.Bytes())
+	if _, ok := err.(*APIError); ok {
+		writeError(w, req, err)
+		return
+	} else if err != nil {
+		InvalidJsonResp(w, req, err)
+		return
+	}
+
+	err = updated.normalize(current, s.cfg.PhoneDefaultRegion)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	err = validateInput(updated)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	if patch := diffProfile(current, updated); !patch.empty() {
+		err = s.patchUser(req.Context(), user.ID, user.Version, patch)
+		if err != nil {
+			writeError(w, req, updateConflict(req, err))
+			return
+		}
+		user.Version++
+	}
+
+	updated.applyTo(&user)
+	w.Header().Set("ETag", userETag(user))
+	user.HashedPassword = ""
+	successResp := SuccessResponse{
+		Message: "success",
+		Data:    user,
+	}
+	jsonResp, err := json.Marshal(successResp)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit allows a burst of Requests requests for a key, refilled
+// evenly over Period. A zero limit does not limit anything
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseRateLimit parses a limit written as requests/period, e.g 10/1m,
+// or off to disable it
+func ParseRateLimit(raw string) (RateLimit, error) {
+	if raw == "off" || raw == "0" {
+		return RateLimit{}, nil
+	}
+	parts := strings.Split(raw, "/")
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("rate limit should look like 10/1m, got %q", raw)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests < 0 {
+		return RateLimit{}, fmt.Errorf("rate limit should start with a number of requests, got %q", raw)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit should end with a positive period, got %q", raw)
+	}
+	return RateLimit{Requests: requests, Period: period}, nil
+}
+
+// Enabled reports whether the limit limits anything
+func (l RateLimit) Enabled() bool {
+	return l.Requests > 0 && l.Period > 0
+}
+
+func (l RateLimit) String() string {
+	if !l.Enabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+// Tokens added to a bucket per nanosecond
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / float64(l.Period)
+}
+
+// RateLimitResult is the state of a bucket after taking a request from it
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+
+	// wait before a request is allowed again, when not allowed
+	RetryAfter time.Duration
+
+	// wait before the bucket is full again
+	Reset time.Duration
+}
+
+// RateLimitStore keeps the token buckets requests are taken from. The
+// in memory store only limits the instance it lives in, deployments running
+// several instances plug in a store shared between them
+type RateLimitStore interface {
+	// Take takes a request from the bucket of key, refilled as limit says
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+// How often full buckets are dropped from the in memory store
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	period  time.Duration
+}
+
+// memoryRateLimitStore keeps the buckets in a map
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+// NewMemoryRateLimitStore returns a store keeping buckets in memory
+func NewMemoryRateLimitStore() RateLimitStore {
+	return newMemoryRateLimitStore(time.Now)
+}
+
+func newMemoryRateLimitStore(now func() time.Time) *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*tokenBucket), now: now, lastSweep: now()}
+}
+
+func (m *memoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	capacity := float64(limit.Requests)
+	bucket, ok := m.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, updated: now}
+		m.buckets[key] = bucket
+	}
+	bucket.period = limit.Period
+	bucket.tokens = math.Min(capacity, bucket.tokens+float64(now.Sub(bucket.updated))*limit.rate())
+	bucket.updated = now
+
+	result := RateLimitResult{Allowed: bucket.tokens >= 1}
+	if result.Allowed {
+		bucket.tokens--
+	} else {
+		result.RetryAfter = time.Duration((1 - bucket.tokens) / limit.rate())
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = time.Duration((capacity - bucket.tokens) / limit.rate())
+	return result, nil
+}
+
+// Drops the buckets that have had time to fill up again, they are the
+// same as a new bucket
+func (m *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for key, bucket := range m.buckets {
+		if now.Sub(bucket.updated) >= bucket.period {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// What requests are counted against
+type rateLimitKey int
+
+const (
+	byIP rateLimitKey = iota
+	byClient
+	byUser
+)
+
+// rateLimitPolicy limits the requests of one kind of caller to a route
+type rateLimitPolicy struct {
+	name  string
+	limit RateLimit
+	key   rateLimitKey
+}
+
+// Returns the bucket a request is taken from. Requests without a client
+// or user are counted against their ip
+func (s *Server) rateLimitBucket(policy rateLimitPolicy, r *http.Request) string {
+	switch policy.key {
+	case byClient:
+		if client, ok := r.Context().Value(clientKey).(string); ok {
+			return policy.name + ":client:" + client
+		}
+	case byUser:
+		const userKey Key = "user"
+		if user, ok := r.Context().Value(userKey).(User); ok {
+			return policy.name + ":user:" + user.ID
+		}
+	}
+	return policy.name + ":ip:" + s.clientIP(r)
+}
+
+// Seconds a duration rounds up to, as sent in headers
+func headerSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Middleware that rejects requests over the limit of policy with a 429.
+// Every response reports the state of the limit in RateLimit-* headers.
+// Requests are let through when the store fails
+func (s *Server) rateLimit(policy rateLimitPolicy, next http.Handler) http.Handler {
+	if !policy.limit.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, err := s.rateLimits.Take(r.Context(), s.rateLimitBucket(policy, r), policy.limit)
+		if err != nil {
+			loggerFrom(r.Context()).Warn("Rate limit store failed, letting request through",
+				"policy", policy.name, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(policy.limit.Requests))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", headerSeconds(result.Reset))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", policy.limit.Requests, headerSeconds(policy.limit.Period)))
+
+		if !result.Allowed {
+			s.metrics.rateLimited.WithLabelValues(policy.name).Inc()
+			w.Header().Set("Retry-After", headerSeconds(result.RetryAfter))
+			writeError(w, r, newAPIError(http.StatusTooManyRequests, CodeRateLimited, "Too many requests, please try again later"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
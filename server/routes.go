@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// current version of the api
+	apiV1Prefix = "/api/v1"
+
+	// prefix of the routes served before the api was versioned
+	legacyPrefix = "/api"
+)
+
+// Date the unversioned routes stop being served
+var legacySunset = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+
+type route struct {
+	path    string
+	handler http.Handler
+}
+
+// Routes of version 1 of the api, relative to the version prefix
+// Requests are limited per ip before authenticating them, then per api
+// client or user
+func (s *Server) v1Routes() []route {
+	var (
+		register = rateLimitPolicy{"register", s.cfg.RateLimitRegister, byIP}
+		login    = rateLimitPolicy{"login", s.cfg.RateLimitLogin, byIP}
+		refresh  = rateLimitPolicy{"refresh_token", s.cfg.RateLimitRefreshToken, byIP}
+		profile  = rateLimitPolicy{"profile", s.cfg.RateLimitProfile, byUser}
+		confirm  = rateLimitPolicy{"email_confirm", s.cfg.RateLimitLogin, byIP}
+		client   = rateLimitPolicy{"client", s.cfg.RateLimitClient, byClient}
+	)
+	return []route{
+		{"/register", s.rateLimit(register, s.BasicToken(s.rateLimit(client, http.HandlerFunc(s.Register))))},
+		{"/login", s.rateLimit(login, s.BasicToken(s.rateLimit(client, http.HandlerFunc(s.Login))))},
+		{"/profile", s.TheUser(s.rateLimit(profile, http.HandlerFunc(s.UserProfile)))},
+		{"/profile/password", s.TheUser(s.rateLimit(profile, http.HandlerFunc(s.ChangePassword)))},
+		{"/profile/email", s.TheUser(s.rateLimit(profile, http.HandlerFunc(s.ChangeEmail)))},
+		{"/users/nearby", s.TheUser(s.rateLimit(profile, http.HandlerFunc(s.NearbyUsers)))},
+		{emailConfirmPath, s.rateLimit(confirm, http.HandlerFunc(s.ConfirmEmail))},
+		{"/refresh-token", s.rateLimit(refresh, http.HandlerFunc(s.RefreshTokenAPI))},
+	}
+}
+
+// Router returns a handler serving every version of the api, logging each
+// request. The unversioned routes are kept as deprecated aliases of v1
+func (s *Server) Router() http.Handler {
+	router := mux.NewRouter()
+	router.Use(s.traceRequests, s.metrics.instrument)
+	router.NotFoundHandler = s.traceRequests(s.metrics.instrument(s.BasicToken(http.HandlerFunc(s.NotAvailable))))
+
+	router.HandleFunc(livenessPath, s.Liveness)
+	router.HandleFunc(readinessPath, s.Readiness)
+	router.Handle(metricsPath, s.metrics.handler())
+
+	for _, r := range s.v1Routes() {
+		router.Handle(apiV1Prefix+r.path, r.handler)
+	}
+	for _, r := range s.v1Routes() {
+		router.Handle(legacyPrefix+r.path, deprecated(apiV1Prefix+r.path, legacySunset, r.handler))
+	}
+
+	router.HandleFunc(openAPIPath, OpenAPI)
+	router.Handle(docsPath, http.RedirectHandler(docsPath+"/", http.StatusMovedPermanently))
+	router.PathPrefix(docsPath + "/").Handler(docsHandler())
+
+	return s.logRequests(router)
+}
+
+// Middleware that marks a route as deprecated in favour of successor
+func deprecated(successor string, sunset time.Time, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+		w.Header().Set("Link", `<`+successor+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Server serves the account api using the settings of its config
+type Server struct {
+	cfg            Config
+	db             Storage
+	tokens         tokenIssuer
+	passwordPolicy PasswordPolicy
+	emails         EmailNormalizer
+	metrics        *metrics
+	logger         *slog.Logger
+	tracer         trace.Tracer
+	rateLimits     RateLimitStore
+	mailer         Mailer
+
+	// set to 1 once the server starts shutting down
+	draining int32
+}
+
+// NewServer creates a server from a config, a connected storage and the
+// logger requests are logged to. A nil logger discards the logs. Spans are
+// reported to the global tracer provider, see SetupTracing
+func NewServer(cfg Config, db Storage, logger *slog.Logger) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	var breached *BreachedPasswords
+	if cfg.BreachedPasswordsFile != "" {
+		list, err := LoadBreachedPasswords(cfg.BreachedPasswordsFile)
+		if err != nil {
+			return nil, err
+		}
+		breached = list
+	}
+
+	if logger == nil {
+		logger = NewLogger(io.Discard, cfg.LogLevel)
+	}
+
+	s := &Server{
+		cfg:            cfg,
+		db:             db,
+		tokens:         newTokenIssuer(cfg),
+		passwordPolicy: cfg.passwordPolicy(breached),
+		emails:         cfg.EmailNormalizer(),
+		metrics:        newMetrics(),
+		logger:         logger,
+		tracer:         otel.GetTracerProvider().Tracer(tracerName),
+		rateLimits:     NewMemoryRateLimitStore(),
+		mailer:         newMailer(cfg, logger),
+	}
+	return s, nil
+}
+
+// UseRateLimitStore replaces the in memory store of the rate limits, so
+// several instances can share their limits. Call it before Router
+func (s *Server) UseRateLimitStore(store RateLimitStore) {
+	s.rateLimits = store
+}
+
+// UseMailer replaces the mailer built from the config
+func (s *Server) UseMailer(mailer Mailer) {
+	s.mailer = mailer
+}
+
+// Draining reports whether the server is shutting down and should
+// no longer receive traffic
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// ListenAndServe serves the api on the configured address until ctx is done,
+// then shuts down gracefully
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.cfg.Address)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Listening", "address", listener.Addr().String())
+	return s.serve(ctx, listener, s.Router())
+}
+
+// Serves handler on listener until ctx is done. On shutdown the server
+// reports not ready for the drain delay, stops accepting connections and
+// waits up to the shutdown timeout for in flight requests to finish
+func (s *Server) serve(ctx context.Context, listener net.Listener, handler http.Handler) error {
+	httpServer := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  s.cfg.ReadTimeout,
+		WriteTimeout: s.cfg.WriteTimeout,
+		IdleTimeout:  s.cfg.IdleTimeout,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	atomic.StoreInt32(&s.draining, 1)
+	s.logger.Info("Shutting down, draining in flight requests", "drain_delay", s.cfg.DrainDelay.String())
+	time.Sleep(s.cfg.DrainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-serveErr; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Every sqlite migration, applied in order of version. Versions are never
+// reused or reordered once released, changes go in a new migration
+var sqliteMigrations = []sqlMigration{
+	{1, "create_users", `
+		CREATE TABLE users (
+			id              text PRIMARY KEY,
+			email           text NOT NULL,
+			hashed_password text NOT NULL DEFAULT '',
+			first_name      text NOT NULL DEFAULT '',
+			phone_number    text NOT NULL DEFAULT '',
+			user_address    text NOT NULL DEFAULT '',
+			is_active       boolean NOT NULL DEFAULT false,
+			date_joined     timestamp NOT NULL,
+			last_login      timestamp NOT NULL,
+			longitude       text NOT NULL DEFAULT '',
+			latitude        text NOT NULL DEFAULT '',
+			device_id       text NOT NULL DEFAULT ''
+		)`,
+		`DROP TABLE users`, nil},
+	{2, "create_email_unique_index",
+		`CREATE UNIQUE INDEX users_email_unique ON users (lower(email))`,
+		`DROP INDEX users_email_unique`, nil},
+	{3, "add_user_version",
+		`ALTER TABLE users ADD COLUMN version integer NOT NULL DEFAULT 1`,
+		`ALTER TABLE users DROP COLUMN version`, nil},
+	// the text columns keep the coordinates that do not convert, so rolling
+	// back loses nothing
+	{4, "add_user_location", `
+		ALTER TABLE users ADD COLUMN location_longitude real;
+		ALTER TABLE users ADD COLUMN location_latitude real;
+		ALTER TABLE users ADD COLUMN discoverable boolean NOT NULL DEFAULT false;
+		UPDATE users SET
+			location_longitude = CAST(longitude AS real),
+			location_latitude  = CAST(latitude AS real)
+			WHERE longitude <> '' AND longitude NOT GLOB '*[^0-9.+-]*'
+			AND latitude <> '' AND latitude NOT GLOB '*[^0-9.+-]*';
+		UPDATE users SET location_longitude = NULL, location_latitude = NULL
+			WHERE location_longitude NOT BETWEEN -180 AND 180 OR location_latitude NOT BETWEEN -90 AND 90;
+		UPDATE users SET longitude = '', latitude = '' WHERE location_longitude IS NOT NULL;
+		CREATE INDEX users_location ON users (location_latitude)`, `
+		UPDATE users SET
+			longitude = CAST(location_longitude AS text),
+			latitude  = CAST(location_latitude AS text)
+			WHERE location_longitude IS NOT NULL;
+		DROP INDEX users_location;
+		ALTER TABLE users DROP COLUMN location_longitude;
+		ALTER TABLE users DROP COLUMN location_latitude;
+		ALTER TABLE users DROP COLUMN discoverable`, nil},
+	{5, "structure_user_contacts", `
+		ALTER TABLE users ADD COLUMN address text;
+		ALTER TABLE users ADD COLUMN unparsed text`, `
+		UPDATE users SET phone_number = json_extract(unparsed, '$.phone_number')
+			WHERE json_extract(unparsed, '$.phone_number') IS NOT NULL;
+		ALTER TABLE users DROP COLUMN address;
+		ALTER TABLE users DROP COLUMN unparsed`,
+		convertSQLUserContacts},
+}
+
+var sqliteDialect = sqlDialect{
+	migrations: sqliteMigrations,
+
+	// transactions take the write lock of the whole database when they
+	// begin, and each migration checks it is still pending once it holds it
+	lockMigrations: func(ctx context.Context, conn *sql.Conn) (func(), error) {
+		return func() {}, nil
+	},
+	uniqueViolation: func(err error) bool {
+		var sqliteErr *sqlite.Error
+		if !errors.As(err, &sqliteErr) {
+			return false
+		}
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	},
+	undefinedTable: func(err error) bool {
+		var sqliteErr *sqlite.Error
+		return errors.As(err, &sqliteErr) && strings.Contains(sqliteErr.Error(), "no such table")
+	},
+}
+
+// SQLite is a sqlite database file holding the accounts, so the service
+// runs without a database server. Only one instance can use the file
+type SQLite struct {
+	sqlStorage
+}
+
+// OpenSQLite opens the configured sqlite database, creating the file when
+// it does not exist
+func OpenSQLite(ctx context.Context, cfg Config, logger *slog.Logger) (*SQLite, error) {
+	// writers wait for each other up to the busy timeout, and transactions
+	// take the write lock as they begin so they never deadlock upgrading it
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)&_txlock=immediate",
+		cfg.SQLitePath, cfg.SQLiteBusyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sqlite_path, %w", err)
+	}
+	// sqlite writes one at a time anyway, a single connection also keeps
+	// an in memory database alive
+	db.SetMaxOpenConns(1)
+
+	pingCtx, cancel := context.WithTimeout(ctx, cfg.SQLiteBusyTimeout)
+	defer cancel()
+	if err := db.PingContext(pingCtx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not open sqlite database %s, %w", cfg.SQLitePath, err)
+	}
+	logger.Info("Opened SQLite database", "path", cfg.SQLitePath)
+	return &SQLite{sqlStorage{db: db, dialect: sqliteDialect, timeout: cfg.SQLiteBusyTimeout}}, nil
+}
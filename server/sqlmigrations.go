@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// sqlMigration is a versioned change to the tables. up and down are run in
+// a transaction, an empty down makes the migration irreversible. convert,
+// when set, changes rows in ways sql can not after up, in the same
+// transaction
+type sqlMigration struct {
+	version int
+	name    string
+	up      string
+	down    string
+	convert func(ctx context.Context, tx *sql.Tx) error
+}
+
+// Migrate applies every migration that is not applied yet, in order, each
+// in its own transaction. Only one instance migrates at a time, the others
+// wait for it to finish
+func (s *sqlStorage) Migrate(ctx context.Context) error {
+	return s.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedSQLMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range s.dialect.migrations {
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			err := inTransaction(ctx, conn, func(tx *sql.Tx) error {
+				if done, err := migrationApplied(ctx, tx, m.version); err != nil || done {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, m.up); err != nil {
+					return err
+				}
+				if m.convert != nil {
+					if err := m.convert(ctx, tx); err != nil {
+						return err
+					}
+				}
+				_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+					m.version, m.name, time.Now().UTC())
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d %s failed, %w", m.version, m.name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Rollback undoes the last steps applied migrations, latest first
+func (s *sqlStorage) Rollback(ctx context.Context, steps int) error {
+	return s.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedSQLMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(s.dialect.migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := s.dialect.migrations[i]
+			if _, ok := applied[m.version]; !ok {
+				continue
+			}
+			if m.down == "" {
+				return fmt.Errorf("migration %d %s can not be rolled back", m.version, m.name)
+			}
+			err := inTransaction(ctx, conn, func(tx *sql.Tx) error {
+				if done, err := migrationApplied(ctx, tx, m.version); err != nil || !done {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, m.down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("rolling back migration %d %s failed, %w", m.version, m.name, err)
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// MigrationStatus reports which migrations are applied
+func (s *sqlStorage) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	applied, err := appliedSQLMigrations(ctx, conn)
+	if s.dialect.undefinedTable(err) {
+		// never migrated, the table does not exist yet
+		applied, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(s.dialect.migrations))
+	for _, m := range s.dialect.migrations {
+		record, ok := applied[m.version]
+		statuses = append(statuses, MigrationStatus{Version: m.version, Name: m.name, Applied: ok, AppliedAt: record.AppliedAt})
+	}
+	return statuses, nil
+}
+
+// Runs fn on a connection holding the migration lock, waiting for it while
+// another runner has it
+func (s *sqlStorage) withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	unlock, err := s.dialect.lockMigrations(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("could not take the migration lock, %w", err)
+	}
+	defer unlock()
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    integer PRIMARY KEY,
+			name       text NOT NULL,
+			applied_at timestamp NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// Returns the recorded migrations keyed by version
+func appliedSQLMigrations(ctx context.Context, conn *sql.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var record appliedMigration
+		if err := rows.Scan(&record.Version, &record.Name, &record.AppliedAt); err != nil {
+			return nil, err
+		}
+		record.AppliedAt = record.AppliedAt.UTC()
+		applied[record.Version] = record
+	}
+	return applied, rows.Err()
+}
+
+// Checks in a transaction whether a migration is applied, for dialects whose
+// lock is the transaction itself
+func migrationApplied(ctx context.Context, tx *sql.Tx, version int) (bool, error) {
+	var count int
+	err := tx.QueryRowContext(ctx, `SELECT count(*) FROM schema_migrations WHERE version = $1`, version).Scan(&count)
+	return count > 0, err
+}
+
+// Runs fn in a transaction on conn, committed when fn succeeds
+func inTransaction(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
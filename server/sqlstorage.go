@@ -0,0 +1,350 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// sqlStorage keeps the users in a SQL database. The queries are shared by
+// postgres and sqlite, what differs between them is in its dialect
+type sqlStorage struct {
+	db      *sql.DB
+	dialect sqlDialect
+
+	// maximum duration of a single storage operation
+	timeout time.Duration
+}
+
+// sqlDialect is what a SQL database does its own way
+type sqlDialect struct {
+	migrations []sqlMigration
+
+	// takes the lock held while migrating on conn, returning its release
+	lockMigrations func(ctx context.Context, conn *sql.Conn) (func(), error)
+
+	// checks if a write failed because it broke a unique constraint
+	uniqueViolation func(err error) bool
+
+	// checks if a query failed because a table does not exist
+	undefinedTable func(err error) bool
+
+	// appended to a select to lock the rows it reads until the transaction
+	// ends, empty when transactions lock the whole database
+	forUpdate string
+}
+
+// Ping checks that the database can be reached
+func (s *sqlStorage) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.db.PingContext(ctx)
+}
+
+// Disconnect closes every connection to the database
+func (s *sqlStorage) Disconnect(ctx context.Context) error {
+	return s.db.Close()
+}
+
+// Columns of the users table, in the order of userValues and scanUser
+const userColumns = `id, email, hashed_password, first_name, phone_number, user_address,
+	is_active, date_joined, last_login, location_longitude, location_latitude, device_id, version, discoverable,
+	address, unparsed`
+
+func userValues(user User) []interface{} {
+	longitude, latitude := locationValues(user.Location)
+	return []interface{}{
+		user.ID, user.Email, user.HashedPassword, user.FirstName, user.PhoneNumber, user.UserAddress,
+		user.IsActive, user.DateJoined, user.LastLogin, longitude, latitude, user.DeviceID, user.Version, user.Discoverable,
+		jsonValue(user.Address), jsonValue(user.Unparsed),
+	}
+}
+
+// Returns the json a column holds for a value, null for an empty one
+func jsonValue(value interface{}) interface{} {
+	if v := reflect.ValueOf(value); !v.IsValid() || v.IsZero() || (v.Kind() == reflect.Map && v.Len() == 0) {
+		return nil
+	}
+	// the values are structs and maps of strings, which always encode
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// Returns the columns a location is stored in, null without a location
+func locationValues(location *GeoPoint) (interface{}, interface{}) {
+	if location == nil {
+		return nil, nil
+	}
+	return location.longitude(), location.latitude()
+}
+
+// Reads a user selected with userColumns
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var (
+		user                User
+		longitude, latitude sql.NullFloat64
+		address, unparsed   sql.NullString
+	)
+	err := row.Scan(
+		&user.ID, &user.Email, &user.HashedPassword, &user.FirstName, &user.PhoneNumber, &user.UserAddress,
+		&user.IsActive, &user.DateJoined, &user.LastLogin, &longitude, &latitude, &user.DeviceID, &user.Version, &user.Discoverable,
+		&address, &unparsed,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errUserNotFound
+	} else if err != nil {
+		return User{}, err
+	}
+	user.DateJoined = user.DateJoined.UTC()
+	user.LastLogin = user.LastLogin.UTC()
+	if longitude.Valid && latitude.Valid {
+		user.Location = newGeoPoint(longitude.Float64, latitude.Float64)
+	}
+	if address.Valid {
+		if err := json.Unmarshal([]byte(address.String), &user.Address); err != nil {
+			return User{}, fmt.Errorf("could not read the address of user %s, %w", user.ID, err)
+		}
+	}
+	if unparsed.Valid {
+		if err := json.Unmarshal([]byte(unparsed.String), &user.Unparsed); err != nil {
+			return User{}, fmt.Errorf("could not read the unparsed fields of user %s, %w", user.ID, err)
+		}
+	}
+	return user, nil
+}
+
+// Add User to the database. The unique index on email rejects a user that
+// already exists, even when registered concurrently
+func (s *sqlStorage) addUser(ctx context.Context, user User) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO users (`+userColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`,
+		userValues(user)...)
+	if s.dialect.uniqueViolation(err) {
+		return errUserExists
+	}
+	return err
+}
+
+// Retrieve User from the database, the email is compared ignoring case
+func (s *sqlStorage) getUser(ctx context.Context, email string) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	row := s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE lower(email) = lower($1)`, email)
+	return scanUser(row)
+}
+
+// Retrieve User from the database by id
+func (s *sqlStorage) getUserByID(ctx context.Context, id string) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	row := s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id)
+	return scanUser(row)
+}
+
+// update details of a user, found by id and version
+func (s *sqlStorage) updateUser(ctx context.Context, user User) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `UPDATE users SET
+		email = $2, hashed_password = $3, first_name = $4, phone_number = $5, user_address = $6,
+		is_active = $7, date_joined = $8, last_login = $9, location_longitude = $10, location_latitude = $11,
+		device_id = $12, discoverable = $14, address = $15, unparsed = $16, version = version + 1
+		WHERE id = $1 AND version = $13`, userValues(user)...)
+	if s.dialect.uniqueViolation(err) {
+		return errUserExists
+	} else if err != nil {
+		return err
+	}
+	return s.checkUpdated(ctx, result, user.ID)
+}
+
+// Tells why an update of the user with id matched nothing, the user is gone
+// or it has another version
+func (s *sqlStorage) checkUpdated(ctx context.Context, result sql.Result, id string) error {
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated > 0 {
+		return nil
+	}
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, id).Scan(&exists)
+	if err != nil {
+		return err
+	} else if !exists {
+		return errUserNotFound
+	}
+	return errVersionConflict
+}
+
+// Writes the changed profile fields of a user, found by id and version.
+// Cleared fields are set to their zero value, objects to null
+func (s *sqlStorage) patchUser(ctx context.Context, id string, version int64, patch userPatch) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	assignments := []string{"version = version + 1"}
+	args := []interface{}{id, version}
+	assign := func(column string, value interface{}) {
+		args = append(args, value)
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	write := func(name string, value interface{}) {
+		// the column comes from profileFields, never from the request
+		field, _ := lookupProfileField(name)
+		switch value := value.(type) {
+		case *GeoPoint:
+			longitude, latitude := locationValues(value)
+			assign("location_longitude", longitude)
+			assign("location_latitude", latitude)
+		case *Address, map[string]string:
+			assign(field.name, jsonValue(value))
+		default:
+			assign(field.name, value)
+		}
+	}
+	for name, value := range patch.set {
+		write(name, value)
+	}
+	for _, name := range patch.unset {
+		field, _ := lookupProfileField(name)
+		write(name, field.cleared())
+	}
+
+	result, err := s.db.ExecContext(ctx, `UPDATE users SET `+strings.Join(assignments, ", ")+` WHERE id = $1 AND version = $2`, args...)
+	if err != nil {
+		return err
+	}
+	return s.checkUpdated(ctx, result, id)
+}
+
+// Most users a search for nearby users measures the distance to, the nearest
+// of the box around the searched area by a flat approximation
+const maxNearbyCandidates = 1000
+
+// Returns the discoverable users within radius meters of center. The
+// database narrows them down to the box of latitudes and longitudes around
+// the searched area, the distances are measured here
+func (s *sqlStorage) nearbyUsers(ctx context.Context, center GeoPoint, radius float64, limit int, exclude string) ([]User, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	south, north := latitudeBand(center, radius)
+	// two ranges of longitudes, for a box crossing the antimeridian
+	west, east := longitudeBand(center, radius)
+	ranges := [4]float64{west, east, west, east}
+	if west > east {
+		ranges = [4]float64{west, 180, -180, east}
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users
+		WHERE discoverable AND id <> $1 AND location_latitude BETWEEN $2 AND $3
+		AND (location_longitude BETWEEN $4 AND $5 OR location_longitude BETWEEN $6 AND $7)
+		ORDER BY (location_latitude - $8) * (location_latitude - $8)
+			+ (location_longitude - $9) * (location_longitude - $9) * $10, id
+		LIMIT $11`,
+		exclude, south, north, ranges[0], ranges[1], ranges[2], ranges[3],
+		center.latitude(), center.longitude(), math.Pow(math.Cos(center.latitude()*math.Pi/180), 2),
+		maxNearbyCandidates)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nearest(center, radius, limit, users), nil
+}
+
+// NormalizeEmails rewrites every stored email to its canonical form, see
+// Database.NormalizeEmails. The users are locked while they are rewritten
+func (s *sqlStorage) NormalizeEmails(ctx context.Context, normalizer EmailNormalizer, dryRun bool) (EmailNormalizationReport, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return EmailNormalizationReport{}, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, email FROM users ORDER BY id`+s.dialect.forUpdate)
+	if err != nil {
+		return EmailNormalizationReport{}, err
+	}
+	var ids, emails []string
+	for rows.Next() {
+		var id, email string
+		if err := rows.Scan(&id, &email); err != nil {
+			rows.Close()
+			return EmailNormalizationReport{}, err
+		}
+		ids = append(ids, id)
+		emails = append(emails, email)
+	}
+	if err := rows.Err(); err != nil {
+		return EmailNormalizationReport{}, err
+	}
+
+	report, changes := planEmailNormalization(emails, normalizer)
+	if dryRun {
+		return report, nil
+	}
+	for i, email := range changes {
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET email = $2, version = version + 1 WHERE id = $1`, ids[i], email); err != nil {
+			return report, err
+		}
+	}
+	return report, tx.Commit()
+}
+
+// Structures the phone number and address of every user, see
+// convertLegacyContact
+func convertSQLUserContacts(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, phone_number, user_address FROM users ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	type legacy struct{ id, phone, address string }
+	var users []legacy
+	for rows.Next() {
+		var user legacy
+		if err := rows.Scan(&user.id, &user.phone, &user.address); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		contact := convertLegacyContact(user.phone, user.address)
+		if contact.phone == user.phone && contact.address == nil && contact.unparsed == nil {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE users SET phone_number = $2, address = $3, unparsed = $4, version = version + 1 WHERE id = $1`,
+			user.id, contact.phone, jsonValue(contact.address), jsonValue(contact.unparsed))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Storage backends the config selects from
+const (
+	storageMongo    = "mongo"
+	storagePostgres = "postgres"
+	storageSQLite   = "sqlite"
+	storageMemory   = "memory"
+)
+
+// Longest wait between two connection attempts
+const maxConnectBackoff = 30 * time.Second
+
+var (
+	// Returned when a user with the same email already exists
+	errUserExists = errors.New("User already exists")
+
+	// Returned when no stored user matches a lookup
+	errUserNotFound = errors.New("User not found")
+
+	// Returned when a user changed since the version an update expects
+	errVersionConflict = errors.New("User was changed by another update")
+)
+
+// Storage keeps the users. Every backend compares emails ignoring case,
+// reports a missing user with errUserNotFound and a taken email with
+// errUserExists, also when two writes race for it. Updates only apply to
+// the version of the user they expect and increment it, otherwise they
+// fail with errVersionConflict
+type Storage interface {
+	addUser(ctx context.Context, user User) error
+	getUser(ctx context.Context, email string) (User, error)
+	getUserByID(ctx context.Context, id string) (User, error)
+	updateUser(ctx context.Context, user User) error
+	patchUser(ctx context.Context, id string, version int64, patch userPatch) error
+
+	// Returns the discoverable users within radius meters of center,
+	// nearest first, leaving out the user with id exclude
+	nearbyUsers(ctx context.Context, center GeoPoint, radius float64, limit int, exclude string) ([]User, error)
+
+	// NormalizeEmails rewrites the stored emails to their canonical form,
+	// see the normalize-emails command
+	NormalizeEmails(ctx context.Context, normalizer EmailNormalizer, dryRun bool) (EmailNormalizationReport, error)
+
+	// Migrate, Rollback and MigrationStatus manage the schema, see the
+	// migrate command
+	Migrate(ctx context.Context) error
+	Rollback(ctx context.Context, steps int) error
+	MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+
+	// Ping checks that the storage can be reached
+	Ping(ctx context.Context) error
+
+	// Disconnect closes every connection to the storage
+	Disconnect(ctx context.Context) error
+}
+
+// OpenStorage connects to the storage backend selected by the config
+func OpenStorage(ctx context.Context, cfg Config, logger *slog.Logger) (Storage, error) {
+	switch cfg.Storage {
+	case storagePostgres:
+		db, err := ConnectPostgres(ctx, cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case storageSQLite:
+		db, err := OpenSQLite(ctx, cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case storageMemory:
+		logger.Warn("Users are kept in memory and lost on exit")
+		return NewMemoryStorage(), nil
+	default:
+		db, err := ConnectDatabase(ctx, cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+}
+
+// Calls connect until it succeeds, retrying with exponential backoff until
+// retries are used up or ctx is done
+func connectWithRetries(ctx context.Context, logger *slog.Logger, retries int, backoff time.Duration, connect func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= retries {
+			return fmt.Errorf("could not connect to db after %d attempts, %w", attempt+1, err)
+		}
+		logger.Warn("Could not connect to db, retrying", "attempt", attempt+1, "backoff", backoff.String(), "error", err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up connecting to db, %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
@@ -0,0 +1,596 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Environment variable pointing the storage tests at a PostgreSQL database
+const testPostgresURLEnv = "ACCOUNT_TEST_POSTGRES_URL"
+
+// Connects to a fresh schema of the PostgreSQL database the tests are
+// pointed at, skipping the test when there is none. The schema is dropped after
+func newTestPostgres(t *testing.T) (*Postgres, Config) {
+	base := os.Getenv(testPostgresURLEnv)
+	if base == "" {
+		t.Skipf("%s is not set", testPostgresURLEnv)
+	}
+
+	admin, err := sql.Open("pgx", base)
+	if err != nil {
+		t.Fatal("Could not open test database with error ", err)
+	}
+	defer admin.Close()
+	schema := fmt.Sprintf("account_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal("Could not create test schema with error ", err)
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatal("Invalid ", testPostgresURLEnv, err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	cfg := DefaultConfig()
+	cfg.Storage = storagePostgres
+	cfg.PostgresURL = u.String()
+	cfg.PostgresConnectRetries = 0
+	cfg.SigningKey = "test-signing-key"
+	cfg.RefreshSigningKey = "test-refresh-signing-key"
+	cfg.BasicToken = "test-basic-token"
+
+	db, err := ConnectPostgres(context.Background(), cfg, NewLogger(io.Discard, "error"))
+	if err != nil {
+		t.Fatal("Could not connect to test database with error ", err)
+	}
+	t.Cleanup(func() {
+		db.Disconnect(context.Background())
+		if admin, err := sql.Open("pgx", base); err == nil {
+			admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+			admin.Close()
+		}
+	})
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatal("Could not migrate test database with error ", err)
+	}
+	return db, cfg
+}
+
+// Opens a sqlite database in a temporary directory, closed after the test
+func newTestSQLite(t *testing.T) (*SQLite, Config) {
+	cfg := DefaultConfig()
+	cfg.Storage = storageSQLite
+	cfg.SQLitePath = filepath.Join(t.TempDir(), "account.db")
+	cfg.SigningKey = "test-signing-key"
+	cfg.RefreshSigningKey = "test-refresh-signing-key"
+	cfg.BasicToken = "test-basic-token"
+
+	db, err := OpenSQLite(context.Background(), cfg, NewLogger(io.Discard, "error"))
+	if err != nil {
+		t.Fatal("Could not open test database with error ", err)
+	}
+	t.Cleanup(func() { db.Disconnect(context.Background()) })
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatal("Could not migrate test database with error ", err)
+	}
+	return db, cfg
+}
+
+// Every storage backend passes the same contract
+func TestStorageContract(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) Storage
+	}{
+		{storageMemory, func(t *testing.T) Storage { return NewMemoryStorage() }},
+		{storageMongo, func(t *testing.T) Storage { db, _ := newTestDatabase(t); return db }},
+		{storagePostgres, func(t *testing.T) Storage { db, _ := newTestPostgres(t); return db }},
+		{storageSQLite, func(t *testing.T) Storage { db, _ := newTestSQLite(t); return db }},
+	}
+	for _, backend := range backends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			testStorage(t, backend.open)
+		})
+	}
+}
+
+func testStorage(t *testing.T, open func(t *testing.T) Storage) {
+	ctx := context.Background()
+	newUser := func(email string) User {
+		// stored times are only as precise as the least precise backend
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		return User{
+			ID:             newUserID(),
+			Email:          email,
+			HashedPassword: "hash",
+			FirstName:      "Ada",
+			PhoneNumber:    "+2348012345678",
+			Address:        &Address{Lines: []string{"1 Marina"}, City: "Lagos", Country: "NG"},
+			UserAddress:    "1 Marina, Lagos, NG",
+			Unparsed:       map[string]string{"user_address": "Marina"},
+			IsActive:       true,
+			DateJoined:     now,
+			LastLogin:      now,
+			Location:       newGeoPoint(3.3792, 6.5244),
+			Discoverable:   true,
+			Version:        1,
+		}
+	}
+
+	t.Run("add and get", func(t *testing.T) {
+		db := open(t)
+		user := newUser("ada@example.com")
+		if err := db.addUser(ctx, user); err != nil {
+			t.Fatal("Could not add user with error ", err)
+		}
+
+		byEmail, err := db.getUser(ctx, "ADA@example.com")
+		if err != nil {
+			t.Fatal("Expected to find the user by email ignoring case, got ", err)
+		}
+		byID, err := db.getUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal("Expected to find the user by id, got ", err)
+		}
+		for _, got := range []User{byEmail, byID} {
+			if !got.DateJoined.Equal(user.DateJoined) || !got.LastLogin.Equal(user.LastLogin) {
+				t.Errorf("Expected times %v, got %v", user.DateJoined, got.DateJoined)
+			}
+			got.DateJoined, got.LastLogin = user.DateJoined, user.LastLogin
+			if !reflect.DeepEqual(got, user) {
+				t.Errorf("Expected %+v, got %+v", user, got)
+			}
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		db := open(t)
+		if _, err := db.getUser(ctx, "nobody@example.com"); !errors.Is(err, errUserNotFound) {
+			t.Errorf("Expected errUserNotFound by email, got %v", err)
+		}
+		if _, err := db.getUserByID(ctx, newUserID()); !errors.Is(err, errUserNotFound) {
+			t.Errorf("Expected errUserNotFound by id, got %v", err)
+		}
+		if err := db.updateUser(ctx, newUser("nobody@example.com")); !errors.Is(err, errUserNotFound) {
+			t.Errorf("Expected errUserNotFound on update, got %v", err)
+		}
+	})
+
+	t.Run("unique email", func(t *testing.T) {
+		db := open(t)
+		if err := db.addUser(ctx, newUser("ada@example.com")); err != nil {
+			t.Fatal("Could not add user with error ", err)
+		}
+		if err := db.addUser(ctx, newUser("Ada@Example.com")); !errors.Is(err, errUserExists) {
+			t.Errorf("Expected errUserExists for the same email in another case, got %v", err)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		db := open(t)
+		ada, bob := newUser("ada@example.com"), newUser("bob@example.com")
+		for _, user := range []User{ada, bob} {
+			if err := db.addUser(ctx, user); err != nil {
+				t.Fatal("Could not add user with error ", err)
+			}
+		}
+
+		ada.FirstName = "Augusta"
+		ada.Email = "augusta@example.com"
+		if err := db.updateUser(ctx, ada); err != nil {
+			t.Fatal("Could not update user with error ", err)
+		}
+		got, err := db.getUserByID(ctx, ada.ID)
+		if err != nil || got.FirstName != "Augusta" || got.Email != "augusta@example.com" {
+			t.Errorf("Expected the update to be stored, got %+v, %v", got, err)
+		}
+		if got.Version != ada.Version+1 {
+			t.Errorf("Expected the update to increment the version to %d, got %d", ada.Version+1, got.Version)
+		}
+		ada.Version++
+		if _, err := db.getUser(ctx, "ada@example.com"); !errors.Is(err, errUserNotFound) {
+			t.Errorf("Expected the old email to be free, got %v", err)
+		}
+
+		ada.Email = "BOB@example.com"
+		if err := db.updateUser(ctx, ada); !errors.Is(err, errUserExists) {
+			t.Errorf("Expected errUserExists taking the email of another user, got %v", err)
+		}
+	})
+
+	t.Run("patch", func(t *testing.T) {
+		db := open(t)
+		user := newUser("ada@example.com")
+		if err := db.addUser(ctx, user); err != nil {
+			t.Fatal("Could not add user with error ", err)
+		}
+
+		address := &Address{Lines: []string{"2 Broad Street"}, City: "Lagos", Region: "Lagos", PostalCode: "101001", Country: "NG"}
+		patch := userPatch{
+			set:   map[string]interface{}{"first_name": "Augusta", "device_id": "tablet", "address": address},
+			unset: []string{"phone_number", "unparsed"},
+		}
+		if err := db.patchUser(ctx, user.ID, user.Version, patch); err != nil {
+			t.Fatal("Could not patch user with error ", err)
+		}
+		got, err := db.getUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal("Could not get user with error ", err)
+		}
+		if got.FirstName != "Augusta" || got.DeviceID != "tablet" || got.PhoneNumber != "" {
+			t.Errorf("Expected the patch to be stored, got %+v", got)
+		}
+		if !reflect.DeepEqual(got.Address, address) || got.Unparsed != nil {
+			t.Errorf("Expected the address to be replaced and unparsed cleared, got %+v", got)
+		}
+		if !reflect.DeepEqual(got.Location, user.Location) || got.HashedPassword != user.HashedPassword || !got.IsActive {
+			t.Errorf("Expected the fields left out of the patch to be kept, got %+v", got)
+		}
+		if got.Version != user.Version+1 {
+			t.Errorf("Expected the patch to increment the version to %d, got %d", user.Version+1, got.Version)
+		}
+
+		if err := db.patchUser(ctx, newUserID(), 1, patch); !errors.Is(err, errUserNotFound) {
+			t.Errorf("Expected errUserNotFound patching a missing user, got %v", err)
+		}
+	})
+
+	t.Run("stale version", func(t *testing.T) {
+		db := open(t)
+		user := newUser("ada@example.com")
+		if err := db.addUser(ctx, user); err != nil {
+			t.Fatal("Could not add user with error ", err)
+		}
+		if err := db.updateUser(ctx, user); err != nil {
+			t.Fatal("Could not update user with error ", err)
+		}
+
+		// both writes expect the version the first update replaced
+		user.FirstName = "Augusta"
+		if err := db.updateUser(ctx, user); !errors.Is(err, errVersionConflict) {
+			t.Errorf("Expected errVersionConflict updating a stale version, got %v", err)
+		}
+		patch := userPatch{set: map[string]interface{}{"first_name": "Augusta"}}
+		if err := db.patchUser(ctx, user.ID, user.Version, patch); !errors.Is(err, errVersionConflict) {
+			t.Errorf("Expected errVersionConflict patching a stale version, got %v", err)
+		}
+		got, err := db.getUserByID(ctx, user.ID)
+		if err != nil || got.FirstName != "Ada" || got.Version != user.Version+1 {
+			t.Errorf("Expected the stale writes to be rejected, got %+v, %v", got, err)
+		}
+
+		missing := newUser("nobody@example.com")
+		if err := db.updateUser(ctx, missing); !errors.Is(err, errUserNotFound) {
+			t.Errorf("Expected errUserNotFound updating a missing user, got %v", err)
+		}
+	})
+
+	t.Run("nearby", func(t *testing.T) {
+		db := open(t)
+		// Lagos, with users about 1km and 5km north of it and one in Abuja
+		center := newUser("center@example.com")
+		near, far, abuja := newUser("near@example.com"), newUser("far@example.com"), newUser("abuja@example.com")
+		near.Location = newGeoPoint(3.3792, 6.5334)
+		far.Location = newGeoPoint(3.3792, 6.5694)
+		abuja.Location = newGeoPoint(7.4951, 9.0579)
+		hidden := newUser("hidden@example.com")
+		hidden.Discoverable = false
+		nowhere := newUser("nowhere@example.com")
+		nowhere.Location = nil
+		for _, user := range []User{center, far, near, abuja, hidden, nowhere} {
+			if err := db.addUser(ctx, user); err != nil {
+				t.Fatal("Could not add user with error ", err)
+			}
+		}
+
+		emails := func(users []User) []string {
+			found := []string{}
+			for _, user := range users {
+				found = append(found, user.Email)
+			}
+			return found
+		}
+		got, err := db.nearbyUsers(ctx, *center.Location, 10000, 10, center.ID)
+		if err != nil {
+			t.Fatal("Could not find nearby users with error ", err)
+		}
+		if want := []string{"near@example.com", "far@example.com"}; !reflect.DeepEqual(emails(got), want) {
+			t.Errorf("Expected %v within 10km, nearest first, got %v", want, emails(got))
+		}
+
+		got, err = db.nearbyUsers(ctx, *center.Location, 10000, 1, center.ID)
+		if err != nil || !reflect.DeepEqual(emails(got), []string{"near@example.com"}) {
+			t.Errorf("Expected only the nearest user with a limit of 1, got %v, %v", emails(got), err)
+		}
+
+		patch := userPatch{unset: []string{"discoverable"}}
+		if err := db.patchUser(ctx, near.ID, near.Version, patch); err != nil {
+			t.Fatal("Could not patch user with error ", err)
+		}
+		got, err = db.nearbyUsers(ctx, *center.Location, 10000, 10, center.ID)
+		if err != nil || !reflect.DeepEqual(emails(got), []string{"far@example.com"}) {
+			t.Errorf("Expected a user opting out to be left out, got %v, %v", emails(got), err)
+		}
+
+		// about 2km apart, across the antimeridian
+		fiji, samoa := newUser("fiji@example.com"), newUser("samoa@example.com")
+		fiji.Location, samoa.Location = newGeoPoint(179.99, -16.5), newGeoPoint(-179.99, -16.5)
+		for _, user := range []User{fiji, samoa} {
+			if err := db.addUser(ctx, user); err != nil {
+				t.Fatal("Could not add user with error ", err)
+			}
+		}
+		got, err = db.nearbyUsers(ctx, *fiji.Location, 10000, 10, fiji.ID)
+		if err != nil || !reflect.DeepEqual(emails(got), []string{"samoa@example.com"}) {
+			t.Errorf("Expected a user across the antimeridian to be found, got %v, %v", emails(got), err)
+		}
+	})
+
+	t.Run("concurrent adds", func(t *testing.T) {
+		db := open(t)
+		const attempts = 8
+		errs := make(chan error, attempts)
+		var wg sync.WaitGroup
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- db.addUser(ctx, newUser("racer@example.com"))
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		added := 0
+		for err := range errs {
+			if err == nil {
+				added++
+			} else if !errors.Is(err, errUserExists) {
+				t.Error("Unexpected error ", err)
+			}
+		}
+		if added != 1 {
+			t.Errorf("Expected one user to be added, got %d", added)
+		}
+	})
+
+	t.Run("normalize emails", func(t *testing.T) {
+		db := open(t)
+		if err := db.addUser(ctx, newUser("Ada@EXAMPLE.com")); err != nil {
+			t.Fatal("Could not add user with error ", err)
+		}
+		report, err := db.NormalizeEmails(ctx, EmailNormalizer{LowercaseLocalPart: true}, false)
+		if err != nil || report.Scanned != 1 || report.Normalized != 1 {
+			t.Fatalf("Unexpected report %+v, %v", report, err)
+		}
+		if user, _ := db.getUser(ctx, "ada@example.com"); user.Email != "ada@example.com" {
+			t.Errorf("Expected the email to be normalized, got %s", user.Email)
+		}
+	})
+
+	t.Run("migrations", func(t *testing.T) {
+		db := open(t)
+		if err := db.Migrate(ctx); err != nil {
+			t.Fatal("Expected migrating again to be a no-op, got ", err)
+		}
+		statuses, err := db.MigrationStatus(ctx)
+		if err != nil {
+			t.Fatal("Could not get migration status with error ", err)
+		}
+		for _, status := range statuses {
+			if !status.Applied {
+				t.Errorf("Expected migration %d %s to be applied", status.Version, status.Name)
+			}
+		}
+		if err := db.Ping(ctx); err != nil {
+			t.Error("Could not ping storage with error ", err)
+		}
+	})
+}
+
+func TestPlanEmailNormalization(t *testing.T) {
+	emails := []string{"Uche@Gmail.com", "uche@gmail.COM", "Ada@Example.com", "bob@example.com"}
+	report, changes := planEmailNormalization(emails, EmailNormalizer{LowercaseLocalPart: true})
+
+	if report.Scanned != 4 || report.Normalized != 1 || len(report.Collisions) != 1 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	if collision := report.Collisions[0]; collision.Email != "uche@gmail.com" || len(collision.Stored) != 2 {
+		t.Errorf("Unexpected collision %+v", collision)
+	}
+	if len(changes) != 1 || changes[2] != "ada@example.com" {
+		t.Errorf("Expected only Ada@Example.com to change, got %v", changes)
+	}
+}
+
+func TestConvertLegacyContact(t *testing.T) {
+	cases := []struct {
+		phone, address string
+		want           legacyContact
+	}{
+		{"", "", legacyContact{}},
+		{"+2348012345678", "", legacyContact{phone: "+2348012345678"}},
+		{"0801 234 5678", "1 Marina, Lagos, ng", legacyContact{
+			phone:   "+2348012345678",
+			address: &Address{Lines: []string{"1 Marina"}, City: "Lagos", Country: "NG"},
+		}},
+		{"020 7946 0958", "Flat 2\n10 Downing Street\nLondon\nGB", legacyContact{
+			phone:   "+442079460958",
+			address: &Address{Lines: []string{"Flat 2", "10 Downing Street"}, City: "London", Country: "GB"},
+		}},
+		{"0801 234 5678", "1 Marina, Lagos", legacyContact{
+			address:  &Address{Lines: []string{"1 Marina"}, City: "Lagos"},
+			unparsed: map[string]string{"phone_number": "0801 234 5678"},
+		}},
+		{"not a phone", "Lagos", legacyContact{
+			unparsed: map[string]string{"phone_number": "not a phone", "user_address": "Lagos"},
+		}},
+	}
+	for _, c := range cases {
+		if got := convertLegacyContact(c.phone, c.address); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Expected %q and %q to convert to %+v, got %+v", c.phone, c.address, c.want, got)
+		}
+	}
+}
+
+func TestStorageConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SigningKey = "test-signing-key"
+	cfg.RefreshSigningKey = "test-refresh-signing-key"
+	cfg.BasicToken = "test-basic-token"
+
+	cfg.Storage = "redis"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected an unknown storage to be rejected")
+	}
+
+	cfg.Storage = storagePostgres
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected the postgres storage to require postgres_url")
+	}
+	cfg.PostgresURL = "postgres://account@localhost:5432/account"
+	if err := cfg.Validate(); err != nil {
+		t.Error("Expected a valid postgres config, got ", err)
+	}
+
+	cfg.Storage = storageMemory
+	cfg.MongoURI = ""
+	db, err := OpenStorage(context.Background(), cfg, NewLogger(io.Discard, "error"))
+	if err != nil {
+		t.Fatal("Could not open memory storage with error ", err)
+	}
+	if _, ok := db.(*MemoryStorage); !ok {
+		t.Errorf("Expected the memory storage, got %T", db)
+	}
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	db, _ := newTestSQLite(t)
+	ctx := context.Background()
+
+	if err := db.Rollback(ctx, len(sqliteMigrations)); err != nil {
+		t.Fatal("Could not roll back with error ", err)
+	}
+	statuses, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal("Could not get migration status with error ", err)
+	}
+	for _, status := range statuses {
+		if status.Applied {
+			t.Errorf("Expected migration %d %s to be rolled back", status.Version, status.Name)
+		}
+	}
+	if _, err := db.getUser(ctx, "ada@example.com"); errors.Is(err, errUserNotFound) || err == nil {
+		t.Error("Expected the users table to be dropped")
+	}
+
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatal("Could not migrate again with error ", err)
+	}
+	if _, err := db.getUser(ctx, "ada@example.com"); !errors.Is(err, errUserNotFound) {
+		t.Errorf("Expected an empty users table, got %v", err)
+	}
+}
+
+func TestSQLiteContactMigration(t *testing.T) {
+	db, _ := newTestSQLite(t)
+	ctx := context.Background()
+
+	if err := db.Rollback(ctx, 1); err != nil {
+		t.Fatal("Could not roll back with error ", err)
+	}
+	legacy := []struct{ id, phone, address string }{
+		{newUserID(), "0801 234 5678", "1 Marina, Lagos, NG"},
+		{newUserID(), "12345", "Lagos"},
+	}
+	for i, user := range legacy {
+		_, err := db.db.ExecContext(ctx, `INSERT INTO users (id, email, phone_number, user_address, date_joined, last_login)
+			VALUES ($1, $2, $3, $4, $5, $5)`, user.id, fmt.Sprintf("user%d@example.com", i), user.phone, user.address, time.Now())
+		if err != nil {
+			t.Fatal("Could not insert legacy user with error ", err)
+		}
+	}
+
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatal("Could not migrate with error ", err)
+	}
+	parsed, err := db.getUserByID(ctx, legacy[0].id)
+	if err != nil {
+		t.Fatal("Could not get user with error ", err)
+	}
+	want := &Address{Lines: []string{"1 Marina"}, City: "Lagos", Country: "NG"}
+	if parsed.PhoneNumber != "+2348012345678" || !reflect.DeepEqual(parsed.Address, want) || parsed.Unparsed != nil {
+		t.Errorf("Expected the contact to be converted, got %+v", parsed)
+	}
+	if parsed.Version != 2 {
+		t.Errorf("Expected the conversion to increment the version, got %d", parsed.Version)
+	}
+	flagged, err := db.getUserByID(ctx, legacy[1].id)
+	if err != nil {
+		t.Fatal("Could not get user with error ", err)
+	}
+	if flagged.PhoneNumber != "" || flagged.Address != nil || flagged.UserAddress != "Lagos" {
+		t.Errorf("Expected the contact that does not parse to be left out, got %+v", flagged)
+	}
+	if want := map[string]string{"phone_number": "12345", "user_address": "Lagos"}; !reflect.DeepEqual(flagged.Unparsed, want) {
+		t.Errorf("Expected %v to be flagged, got %v", want, flagged.Unparsed)
+	}
+
+	if err := db.Rollback(ctx, 1); err != nil {
+		t.Fatal("Could not roll back with error ", err)
+	}
+	var phone string
+	if err := db.db.QueryRowContext(ctx, `SELECT phone_number FROM users WHERE id = $1`, legacy[1].id).Scan(&phone); err != nil || phone != "12345" {
+		t.Errorf("Expected the rollback to restore the unparsed phone number, got %q, %v", phone, err)
+	}
+}
+
+func TestSQLiteServer(t *testing.T) {
+	db, cfg := newTestSQLite(t)
+	s, err := NewServer(cfg, db, nil)
+	if err != nil {
+		t.Fatal("Could not create server with error ", err)
+	}
+	router := s.Router()
+
+	body := `{"email":"Ada@Example.com","password":"c0rrect-Horse-battery","confirm_password":"c0rrect-Horse-battery"}`
+	for _, want := range []int{http.StatusOK, http.StatusConflict} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/register", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer test-basic-token")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Fatalf("Expected register to return %d, got %d: %s", want, rr.Code, rr.Body.String())
+		}
+	}
+
+	body = `{"email":"ada@example.com","password":"c0rrect-Horse-battery"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/login", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer test-basic-token")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected to login, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if stored, err := db.getUser(context.Background(), "ada@example.com"); err != nil || stored.Discoverable {
+		t.Errorf("Expected new users to stay undiscoverable until they opt in, got %+v, %v", stored, err)
+	}
+}
@@ -1,8 +1,6 @@
 package server
 
 import (
-	"fmt"
-	"log"
 	"net/http"
 	"reflect"
 	"strings"
@@ -12,14 +10,34 @@ import (
 )
 
 var (
-	validate = validator.New()
+	validate = newValidator()
 )
 
+// Creates a validator that reports fields by their json name
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return strings.ToLower(field.Name)
+		}
+		return name
+	})
+	v.RegisterStructValidation(validateGeoPoint, GeoPoint{})
+	v.RegisterValidation("country_code", isCountryCode)
+	return v
+}
+
 type loginResponse struct {
+	ID           string    `json:"id"`
 	Email        string    `json:"email"`
 	FirstName    string    `json:"first_name"`
 	PhoneNumber  string    `json:"phone_number"`
 	UserAddress  string    `json:"user_address"`
+	Address      *Address  `json:"address"`
 	IsActive     bool      `json:"is_active"`
 	DateJoined   time.Time `json:"date_joined"`
 	LastLogin    time.Time `json:"last_login"`
@@ -33,75 +51,77 @@ type SuccessResponse struct {
 }
 
 // Helper function for invalid json responses
-func InvalidJsonResp(w http.ResponseWriter, err error) {
+func InvalidJsonResp(w http.ResponseWriter, req *http.Request, err error) {
 	if err.Error() == "EOF" {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, `{"error" : "Invalid Payload"}`)
+		writeError(w, req, newAPIError(http.StatusBadRequest, CodeInvalidPayload, "Invalid Payload"))
 		return
 	}
-	w.WriteHeader(http.StatusBadRequest)
-	fmt.Fprintf(w, `{"error" : "%s"}`, err.Error())
+	message, _ := defaultLocalizer.T(CodeInvalidJSON, err.Error())
+	apiErr := newAPIError(http.StatusBadRequest, CodeInvalidJSON, message)
+	apiErr.params = []string{err.Error()}
+	writeError(w, req, apiErr)
 }
 
 // Helper function for invalid methods
-func MethodNotAllowedResponse(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusMethodNotAllowed)
-	fmt.Fprint(w, `{"message" : "Method Not allowed"}`)
+func MethodNotAllowedResponse(w http.ResponseWriter, req *http.Request) {
+	writeError(w, req, newAPIError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method Not allowed"))
 }
 
 // Helper function for internal server error
-func InternalIssues(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusInternalServerError)
-	fmt.Fprint(w, `{"error" : "Something went wrong"}`)
+func InternalIssues(w http.ResponseWriter, req *http.Request) {
+	writeError(w, req, newAPIError(http.StatusInternalServerError, CodeInternal, "Something went wrong"))
 }
 
 // Helper function for unauthenticated responses
-func unauthorizedResponse(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusForbidden)
-	fmt.Fprint(w, `{"error" : "Invalid authentication credentials"}`)
+func unauthorizedResponse(w http.ResponseWriter, req *http.Request) {
+	writeError(w, req, newAPIError(http.StatusForbidden, CodeInvalidCredentials, "Invalid authentication credentials"))
+}
+
+// Builds the field error for a single failed validation rule
+func validationFieldError(err validator.FieldError) FieldError {
+	name := err.Field()
+	isText := err.Kind() == reflect.String || err.Kind() == reflect.Slice || err.Kind() == reflect.Map
+
+	switch err.Tag() {
+	case "required", "email", "e164", "latitude", "longitude", "geojson_point", "country_code":
+		return newFieldError(err.Tag(), "field."+err.Tag(), name)
+	case "eqfield":
+		return newFieldError(err.Tag(), "field.eqfield", name, err.Param())
+	case "min", "max":
+		key := "field." + err.Tag()
+		if isText {
+			key += "_length"
+		}
+		return newFieldError(err.Tag(), key, name, err.Param())
+	case "oneof":
+		return newFieldError(err.Tag(), "field.oneof", name, strings.Join(strings.Fields(err.Param()), ", "))
+	default:
+		return newFieldError(err.Tag(), "field.invalid", name)
+	}
 }
 
-// Validates a struct
-func validateInput(object interface{}) (error, bool) {
+// Validates a struct, returning every failing field keyed by its json name
+func validateInput(object interface{}) error {
 
 	err := validate.Struct(object)
-	if err != nil {
+	if err == nil {
+		return nil
+	}
 
-		//Validation syntax is invalid
-		if _, ok := err.(*validator.InvalidValidationError); ok {
-			log.Println(err)
-			return err, false
-		}
+	//Validation syntax is invalid
+	validationErrors, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return err
+	}
 
-		if len(err.(validator.ValidationErrors)) > 1 {
-			log.Println("Error is more than one")
-			return err, true
-		}
+	apiErr := newAPIError(http.StatusBadRequest, CodeValidationFailed, "Invalid Payload")
+	apiErr.Fields = make(map[string]FieldError, len(validationErrors))
+	for _, err := range validationErrors {
+		apiErr.Fields[err.Field()] = validationFieldError(err)
+	}
 
-		for _, err := range err.(validator.ValidationErrors) {
-
-			// Retrieve json field
-			reflectedValue := reflect.ValueOf(object)
-			field, _ := reflectedValue.Type().FieldByName(err.StructField())
-
-			var name string
-			if name = field.Tag.Get("json"); name == "" {
-				name = strings.ToLower(err.StructField())
-			}
-
-			switch err.Tag() {
-			case "required":
-				return fmt.Errorf("%s is required", name), false
-			case "email":
-				return fmt.Errorf("%s should be a valid email address", name), false
-			case "eqfield":
-				return fmt.Errorf("%s should be the same as %s", name, err.Param()), false
-			default:
-				log.Println(err.Tag())
-				return fmt.Errorf("%s is Invalid", name), false
-			}
-		}
-		return err, false
+	if len(validationErrors) == 1 {
+		apiErr.Message = apiErr.Fields[validationErrors[0].Field()].Message
 	}
-	return nil, false
+	return apiErr
 }